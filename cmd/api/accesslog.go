@@ -0,0 +1,137 @@
+// Filename: cmd/api/accesslog.go
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// access log key
+const accessLogContextKey = contextKey("access_log")
+
+// An accessLogEntry collects what inner handlers learn about a request, the
+// route it matched and who sent it, for the access log written at the end
+type accessLogEntry struct {
+	route  string
+	userID int64 // zero for anonymous requests
+}
+
+// accessLogEntryFor() returns the entry of a request, nil when it isn't logged
+func accessLogEntryFor(r *http.Request) *accessLogEntry {
+	entry, _ := r.Context().Value(accessLogContextKey).(*accessLogEntry)
+	return entry
+}
+
+// The responseRecorder remembers the status and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Unwrap() lets http.ResponseController reach the real writer
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// observeRequests() counts every request in the metrics and writes one log
+// entry per request once it has been served. Failed requests are always
+// logged, successful ones are sampled
+func (app *application) observeRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessLogEntry{}
+		rec := &responseRecorder{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogContextKey, entry))
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		duration := time.Since(start)
+		route := entry.route
+		if route == "" {
+			route = "unmatched"
+		}
+		app.metrics.observeRequest(r, route, rec.status, duration)
+
+		if !app.config.accessLog.enabled || app.config.accessLog.skipRoutes[entry.route] {
+			return
+		}
+		if rec.status < 400 && rand.Float64() >= app.config.accessLog.sampleRate {
+			return
+		}
+		properties := map[string]string{
+			"method":      r.Method,
+			"route":       route,
+			"status":      strconv.Itoa(rec.status),
+			"bytes":       strconv.Itoa(rec.bytes),
+			"duration_ms": strconv.FormatFloat(float64(duration.Microseconds())/1000, 'f', 3, 64),
+			"client_ip":   app.clientIP(r),
+			"user_agent":  r.UserAgent(),
+		}
+		if entry.userID != 0 {
+			properties["user_id"] = strconv.FormatInt(entry.userID, 10)
+		}
+		app.requestLogger(r).PrintInfo("request served", properties)
+	})
+}
+
+// A routeRecorder registers routes like httprouter and also remembers their
+// patterns, so the access log and metrics can name the route of a request
+// even when a middleware refuses it before it reaches the router. Paths
+// alone would mix in record ids
+type routeRecorder struct {
+	*httprouter.Router
+	patterns *httprouter.Router
+}
+
+func newRouteRecorder() routeRecorder {
+	return routeRecorder{Router: httprouter.New(), patterns: httprouter.New()}
+}
+
+func (rr routeRecorder) Handler(method, path string, handler http.Handler) {
+	rr.Router.Handler(method, path, handler)
+	rr.patterns.Handle(method, path, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if entry := accessLogEntryFor(r); entry != nil {
+			entry.route = path
+		}
+	})
+}
+
+func (rr routeRecorder) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	rr.Handler(method, path, handler)
+}
+
+// matchRoute() looks up the pattern a request will match before the rest of
+// the middleware runs
+func (rr routeRecorder) matchRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if record, _, _ := rr.patterns.Lookup(r.Method, r.URL.Path); record != nil {
+			record(w, r, nil)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
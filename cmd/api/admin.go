@@ -0,0 +1,261 @@
+// Filename: cmd/api/admin.go
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"forum.kevin.net/internal/data"
+	"forum.kevin.net/internal/validator"
+)
+
+// List every permission code that can be granted
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	permissions, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Search users by email address
+func (app *application) searchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Email = app.readString(qs, "email", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortList = []string{"id", "email", "createdat", "-id", "-email", "-createdat"}
+
+	if data.ValidateFilter(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	users, metadata, err := app.models.Users.Search(input.Email, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Show what a user can do and where it comes from
+func (app *application) showUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	granted, err := app.models.Permissions.GetDirectForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	forumGrants, err := app.models.Permissions.GetForumGrantsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+	env := envelope{
+		"user_id":      user.ID,
+		"permissions":  permissions,
+		"granted":      granted,
+		"forum_grants": forumGrants,
+		"roles":        roles,
+	}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Grant permission codes to a user, everywhere or in one forum
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserPermissions(w, r, false)
+}
+
+// Revoke permission codes granted directly to a user
+func (app *application) revokeUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserPermissions(w, r, true)
+}
+
+// The grant and revoke handlers only differ in the change they make
+func (app *application) changeUserPermissions(w http.ResponseWriter, r *http.Request, revoke bool) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Codes   data.Permissions `json:"codes"`
+		ForumID *int64           `json:"forum_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidatePermissionCodes(v, input.Codes, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// A scoped grant needs a forum to be scoped to
+	if input.ForumID != nil && !revoke {
+		_, err := app.models.Forums.Get(*input.ForumID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("forum_id", "must be an existing forum")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+	event := app.newAuditEvent(r, "permissions.grant", "user", user.ID)
+	if revoke {
+		event.Action = "permissions.revoke"
+	}
+	if input.ForumID != nil {
+		event.Details = map[string]interface{}{"forum_id": *input.ForumID}
+	}
+	switch {
+	case input.ForumID != nil && revoke:
+		err = app.models.Permissions.RevokeForUserInForum(user.ID, *input.ForumID, input.Codes, event)
+	case input.ForumID != nil:
+		err = app.models.Permissions.GrantForUserInForum(user.ID, *input.ForumID, input.Codes, event)
+	case revoke:
+		err = app.models.Permissions.RevokeForUser(user.ID, input.Codes, event)
+	default:
+		err = app.models.Permissions.GrantForUser(user.ID, input.Codes, event)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user_id": user.ID, "permissions": permissions, "changed": event.Details["codes"]}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Give a user a role
+func (app *application) assignUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserRole(w, r, false)
+}
+
+// Take a role away from a user
+func (app *application) removeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserRole(w, r, true)
+}
+
+// The assign and remove handlers only differ in the change they make
+func (app *application) changeUserRole(w http.ResponseWriter, r *http.Request, remove bool) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Role string `json:"role"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if v.Check(input.Role != "", "role", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	exists, err := app.models.Roles.Exists(input.Role)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !exists {
+		v.AddError("role", "must be an existing role")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	event := app.newAuditEvent(r, "roles.assign", "user", user.ID)
+	if remove {
+		event.Action = "roles.remove"
+		err = app.models.Roles.RemoveFromUser(user.ID, input.Role, event)
+	} else {
+		err = app.models.Roles.AssignToUser(user.ID, input.Role, event)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user_id": user.ID, "roles": roles, "changed": event.Details["changed"]}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readUserParam() helper loads the user named by the :id parameter and
+// writes the response itself if it can't
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundReponse(w, r)
+		return nil, false
+	}
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundReponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
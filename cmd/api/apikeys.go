@@ -0,0 +1,186 @@
+// Filename: cmd/api/apikeys.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"forum.kevin.net/internal/data"
+	"forum.kevin.net/internal/validator"
+)
+
+// Create a service account that gets some of the current user's permissions
+func (app *application) createServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Permissions []string `json:"permissions"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	user := app.contextGetUser(r)
+	account := &data.ServiceAccount{
+		Name:        input.Name,
+		OwnerID:     user.ID,
+		Permissions: input.Permissions,
+	}
+	v := validator.New()
+	if data.ValidateServiceAccount(v, account); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// A user can only hand out permissions they hold themselves
+	permissions, err := app.permissionsFor(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !permissions.IncludeAll(account.Permissions...) {
+		v.AddError("permissions", "must be a subset of your own permissions")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.ServiceAccounts.Insert(account)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.audit(r, "service_account.create", "user", account.ID, nil, account)
+	err = app.writeJSON(w, http.StatusCreated, envelope{"service_account": account}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// List the current user's service accounts
+func (app *application) listServiceAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	accounts, err := app.models.ServiceAccounts.GetAllForOwner(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"service_accounts": accounts}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Create an API key for the current user or one of their service accounts
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name             string     `json:"name"`
+		Permissions      []string   `json:"permissions"`
+		Expiry           *time.Time `json:"expiry"`
+		IPAllowlist      []string   `json:"ip_allowlist"`
+		ServiceAccountID *int64     `json:"service_account_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	user := app.contextGetUser(r)
+	key := &data.APIKey{
+		UserID:      user.ID,
+		Name:        input.Name,
+		Permissions: input.Permissions,
+		Expiry:      input.Expiry,
+		IPAllowlist: input.IPAllowlist,
+	}
+	v := validator.New()
+	if data.ValidateAPIKey(v, key); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// The key belongs to a service account if one was named
+	if input.ServiceAccountID != nil {
+		account, err := app.models.ServiceAccounts.GetForOwner(user.ID, *input.ServiceAccountID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("service_account_id", "must be one of your service accounts")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		key.UserID = account.ID
+	}
+	// The key can only carry permissions both the caller and its owner hold
+	permissions, err := app.permissionsFor(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if key.UserID != user.ID {
+		owner, err := app.models.Permissions.GetAllForUser(key.UserID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		permissions = permissions.Intersect(owner)
+	}
+	if !permissions.IncludeAll(key.Permissions...) {
+		v.AddError("permissions", "must be a subset of the owner's permissions")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.APIKeys.Insert(key)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Never write the plaintext key to the log
+	logged := *key
+	logged.Plaintext = ""
+	app.audit(r, "api_key.create", "api_key", key.ID, nil, logged)
+	// The plaintext key is only ever shown here
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// List the keys of the current user and their service accounts
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	keys, err := app.models.APIKeys.GetAllForOwner(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revoke an API key
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundReponse(w, r)
+		return
+	}
+	user := app.contextGetUser(r)
+	err = app.models.APIKeys.DeleteForOwner(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundReponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.audit(r, "api_key.delete", "api_key", id, nil, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "api key successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
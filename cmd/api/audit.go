@@ -0,0 +1,77 @@
+// Filename: cmd/api/audit.go
+package main
+
+import (
+	"net/http"
+
+	"forum.kevin.net/internal/data"
+	"forum.kevin.net/internal/validator"
+)
+
+// newAuditEvent() starts an event for a change made by this request. The
+// actor is left empty for anonymous requests such as signups
+func (app *application) newAuditEvent(r *http.Request, action, targetType string, targetID int64) *data.AuditEvent {
+	event := &data.AuditEvent{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   &targetID,
+		IP:         app.clientIP(r),
+		RequestID:  requestID(r),
+	}
+	if user := app.contextGetUser(r); !user.IsAnonymous() {
+		event.ActorID = &user.ID
+	}
+	return event
+}
+
+// audit() records a change that has already been made. By then the client
+// has to be told it succeeded, so a failure is logged rather than returned
+func (app *application) audit(r *http.Request, action, targetType string, targetID int64, before, after interface{}) {
+	event := app.newAuditEvent(r, action, targetType, targetID)
+	err := event.SetDiff(before, after)
+	if err == nil {
+		err = app.models.Audit.Insert(event)
+	}
+	if err != nil {
+		app.requestLogger(r).PrintError(err, map[string]string{
+			"audit_action": action,
+			"request_id":   event.RequestID,
+		})
+	}
+}
+
+// Search the audit log
+func (app *application) listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.AuditFilter
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.ActorID = int64(app.readInt(qs, "actor_id", 0, v))
+	input.Action = app.readString(qs, "action", "")
+	input.TargetType = app.readString(qs, "target_type", "")
+	input.TargetID = int64(app.readInt(qs, "target_id", 0, v))
+	input.From = app.readTime(qs, "from", v)
+	input.To = app.readTime(qs, "to", v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortList = []string{"id", "createdat", "action", "-id", "-createdat", "-action"}
+
+	if data.ValidateFilter(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	events, metadata, err := app.models.Audit.GetAll(input.AuditFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"audit_events": events, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
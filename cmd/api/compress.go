@@ -0,0 +1,198 @@
+// Filename: cmd/api/compress.go
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Header clients can set instead of the compact query parameter
+const compactJSONHeader = "X-Compact-JSON"
+
+// gzip writers are reused, each one holds sizeable buffers
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+// A negotiatedWriter holds back the start of a response until it knows
+// whether it is worth compressing: the body must reach the minimum size and
+// be of a type that compresses well
+type negotiatedWriter struct {
+	http.ResponseWriter
+	app         *application
+	encoding    string // accepted by the client, "" for none
+	compact     bool   // the client asked for JSON without indentation
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	gz          *gzip.Writer
+}
+
+func (nw *negotiatedWriter) WriteHeader(status int) {
+	if nw.wroteHeader {
+		return
+	}
+	nw.wroteHeader = true
+	nw.status = status
+}
+
+func (nw *negotiatedWriter) Write(b []byte) (int, error) {
+	if !nw.wroteHeader {
+		nw.WriteHeader(http.StatusOK)
+	}
+	if !nw.decided {
+		nw.buf = append(nw.buf, b...)
+		if len(nw.buf) < nw.app.config.compress.minSize {
+			return len(b), nil
+		}
+		if err := nw.start(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if nw.gz != nil {
+		return nw.gz.Write(b)
+	}
+	return nw.ResponseWriter.Write(b)
+}
+
+// start() decides on the encoding, sends the header and whatever body has
+// been held back
+func (nw *negotiatedWriter) start() error {
+	nw.decided = true
+	if nw.shouldCompress() {
+		h := nw.Header()
+		h.Set("Content-Encoding", nw.encoding)
+		h.Del("Content-Length")
+		nw.gz = gzipWriters.Get().(*gzip.Writer)
+		nw.gz.Reset(nw.ResponseWriter)
+	}
+	nw.ResponseWriter.WriteHeader(nw.status)
+	if len(nw.buf) == 0 {
+		return nil
+	}
+	var err error
+	if nw.gz != nil {
+		_, err = nw.gz.Write(nw.buf)
+	} else {
+		_, err = nw.ResponseWriter.Write(nw.buf)
+	}
+	nw.buf = nil
+	return err
+}
+
+func (nw *negotiatedWriter) shouldCompress() bool {
+	if nw.encoding == "" || len(nw.buf) < nw.app.config.compress.minSize {
+		return false
+	}
+	if nw.status < 200 || nw.status == http.StatusNoContent || nw.status == http.StatusNotModified {
+		return false
+	}
+	h := nw.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && nw.app.config.compress.types[mediaType]
+}
+
+// finish() completes the response once the handler has returned
+func (nw *negotiatedWriter) finish() {
+	if !nw.wroteHeader {
+		return
+	}
+	if !nw.decided {
+		nw.start()
+	}
+	if nw.gz != nil {
+		nw.gz.Close()
+		gzipWriters.Put(nw.gz)
+		nw.gz = nil
+	}
+}
+
+// Unwrap() lets http.ResponseController reach the real writer
+func (nw *negotiatedWriter) Unwrap() http.ResponseWriter {
+	return nw.ResponseWriter
+}
+
+// negotiateResponse() compresses responses for clients that accept gzip and
+// records whether they asked for compact JSON
+func (app *application) negotiateResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The body depends on these, caches must keep them apart
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.Header().Add("Vary", compactJSONHeader)
+
+		nw := &negotiatedWriter{
+			ResponseWriter: w,
+			app:            app,
+			compact:        wantsCompactJSON(r),
+		}
+		if app.config.compress.enabled && r.Method != http.MethodHead {
+			nw.encoding = acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		}
+		defer nw.finish()
+		next.ServeHTTP(nw, r)
+	})
+}
+
+// wantsCompactJSON() reads the compact query parameter or header
+func wantsCompactJSON(r *http.Request) bool {
+	value := r.URL.Query().Get("compact")
+	if value == "" {
+		value = r.Header.Get(compactJSONHeader)
+	}
+	compact, err := strconv.ParseBool(value)
+	return err == nil && compact
+}
+
+// compactJSONRequested() reports whether the request being answered through
+// w asked for compact JSON
+func compactJSONRequested(w http.ResponseWriter) bool {
+	for {
+		switch writer := w.(type) {
+		case *negotiatedWriter:
+			return writer.compact
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = writer.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// acceptedEncoding() picks gzip if the Accept-Encoding header allows it,
+// either by name or through "*", and does not give it a quality of zero
+func acceptedEncoding(header string) string {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if name, value, found := strings.Cut(strings.TrimSpace(params), "="); found && strings.TrimSpace(name) == "q" {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ > 0 || (gzipQ < 0 && anyQ > 0) {
+		return "gzip"
+	}
+	return ""
+}
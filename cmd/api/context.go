@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"forum.kevin.net/internal/data"
+	"forum.kevin.net/internal/jsonlog"
 )
 
 // Define a custom contextKey type
@@ -14,8 +15,30 @@ type contextKey string
 // user key
 const userContextKey = contextKey("user")
 
+// token key
+const tokenContextKey = contextKey("token")
+
+// permissions key
+const permissionsContextKey = contextKey("permissions")
+
+// restricted credential key
+const restrictedContextKey = contextKey("restricted")
+
+// client IP key
+const clientIPContextKey = contextKey("client_ip")
+
+// request id and request logger keys
+const (
+	requestIDContextKey = contextKey("request_id")
+	loggerContextKey    = contextKey("logger")
+)
+
 // Add user to context
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	// The access log records who sent the request
+	if entry := accessLogEntryFor(r); entry != nil && !user.IsAnonymous() {
+		entry.userID = user.ID
+	}
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
@@ -28,3 +51,69 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// Add the authentication token used for the request to the context
+func (app *application) contextSetToken(r *http.Request, token *data.Token) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// Retrieve the authentication token, nil if the request did not use one
+func (app *application) contextGetToken(r *http.Request) *data.Token {
+	token, _ := r.Context().Value(tokenContextKey).(*data.Token)
+	return token
+}
+
+// Add permissions that were resolved while authenticating the request
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// Retrieve the permissions, ok is false if they still have to be looked up
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
+
+// Mark the request's credential as limited to a subset of its owner's
+// permissions, such as an API key or an OAuth token. Such credentials never
+// get per-forum grants
+func (app *application) contextSetRestricted(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), restrictedContextKey, true)
+	return r.WithContext(ctx)
+}
+
+// Check if the request's credential is restricted
+func (app *application) contextRestricted(r *http.Request) bool {
+	restricted, _ := r.Context().Value(restrictedContextKey).(bool)
+	return restricted
+}
+
+// Add the resolved address of the client
+func (app *application) contextSetClientIP(r *http.Request, ip string) *http.Request {
+	ctx := context.WithValue(r.Context(), clientIPContextKey, ip)
+	return r.WithContext(ctx)
+}
+
+// Add the request id and a logger that records it with every entry
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	ctx = context.WithValue(ctx, loggerContextKey, app.logger.With(map[string]string{"request_id": id}))
+	return r.WithContext(ctx)
+}
+
+// requestID() returns the id of the request, "" outside of one
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// requestLogger() returns the logger for entries made while serving a
+// request, falling back to the application's own
+func (app *application) requestLogger(r *http.Request) *jsonlog.Logger {
+	if logger, ok := r.Context().Value(loggerContextKey).(*jsonlog.Logger); ok {
+		return logger
+	}
+	return app.logger
+}
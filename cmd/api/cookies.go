@@ -0,0 +1,114 @@
+// Filename: cmd/api/cookies.go
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"forum.kevin.net/internal/data"
+)
+
+// Cookies and header used by browser clients in session mode
+const (
+	sessionCookieName = "forum_session"
+	refreshCookieName = "forum_refresh"
+	csrfCookieName    = "forum_csrf"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+// sameSite() maps the configured SameSite mode onto its http constant
+func (app *application) sameSite() http.SameSite {
+	switch app.config.session.sameSite {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+// setSessionCookies() stores the tokens in HttpOnly cookies and sets a
+// readable CSRF cookie. The CSRF token is returned so cross-origin clients,
+// which cannot read our cookies, still learn it
+func (app *application) setSessionCookies(w http.ResponseWriter, access, refresh *data.Token) (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	csrfToken := base64.RawURLEncoding.EncodeToString(randomBytes)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    access.Plaintext,
+		Path:     "/",
+		Expires:  access.Expiry,
+		HttpOnly: true,
+		Secure:   app.config.session.secure,
+		SameSite: app.sameSite(),
+	})
+	// The refresh cookie is only ever sent to the refresh endpoint
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    refresh.Plaintext,
+		Path:     "/v1/tokens/refresh",
+		Expires:  refresh.Expiry,
+		HttpOnly: true,
+		Secure:   app.config.session.secure,
+		SameSite: app.sameSite(),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrfToken,
+		Path:     "/",
+		Expires:  refresh.Expiry,
+		Secure:   app.config.session.secure,
+		SameSite: app.sameSite(),
+	})
+	return csrfToken, nil
+}
+
+// clearSessionCookies() tells the browser to drop every session cookie
+func (app *application) clearSessionCookies(w http.ResponseWriter) {
+	for _, cookie := range []struct{ name, path string }{
+		{sessionCookieName, "/"},
+		{refreshCookieName, "/v1/tokens/refresh"},
+		{csrfCookieName, "/"},
+	} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookie.name,
+			Value:    "",
+			Path:     cookie.path,
+			Expires:  time.Unix(0, 0),
+			MaxAge:   -1,
+			HttpOnly: cookie.name != csrfCookieName,
+			Secure:   app.config.session.secure,
+			SameSite: app.sameSite(),
+		})
+	}
+}
+
+// validCSRF() checks the double-submitted CSRF token: the header must match
+// the cookie, which a cross-site attacker can neither read nor set
+func (app *application) validCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	header := r.Header.Get(csrfHeaderName)
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
+
+// safeMethod() reports whether a request method cannot change state
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,72 @@
+// Filename: cmd/api/cors.go
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// What browsers may send and read in cross-origin requests
+const (
+	corsAllowedMethods = "OPTIONS, GET, POST, PUT, PATCH, DELETE"
+	corsAllowedHeaders = "Authorization, Content-Type, X-CSRF-Token, X-Request-ID, If-Match, If-None-Match, X-Compact-JSON, Idempotency-Key"
+	corsExposedHeaders = "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, X-Request-ID, ETag, Idempotent-Replayed"
+)
+
+// An originPattern is a trusted origin. A host starting with "*." matches
+// any subdomain of the rest, but not the rest itself
+type originPattern struct {
+	scheme string
+	host   string // without the "*." when wildcard is set
+	port   string
+	wild   bool
+}
+
+// parseOriginPattern() reads a trusted origin such as https://example.com
+// or https://*.example.com:8443
+func parseOriginPattern(s string) (originPattern, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return originPattern{}, fmt.Errorf("invalid trusted origin %q", s)
+	}
+	p := originPattern{
+		scheme: strings.ToLower(u.Scheme),
+		host:   strings.ToLower(u.Hostname()),
+		port:   u.Port(),
+	}
+	if strings.HasPrefix(p.host, "*.") {
+		p.wild = true
+		p.host = strings.TrimPrefix(p.host, "*.")
+	}
+	if p.host == "" || strings.Contains(p.host, "*") {
+		return originPattern{}, fmt.Errorf("invalid trusted origin %q, wildcards are only allowed as the first label", s)
+	}
+	return p, nil
+}
+
+// matches() checks the Origin header of a request against the pattern
+func (p originPattern) matches(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if strings.ToLower(u.Scheme) != p.scheme || u.Port() != p.port {
+		return false
+	}
+	if p.wild {
+		return strings.HasSuffix(host, "."+p.host)
+	}
+	return host == p.host
+}
+
+// trustedOrigin() reports whether any configured pattern matches an origin
+func (app *application) trustedOrigin(origin string) bool {
+	for _, pattern := range app.config.cors.trustedOrigins {
+		if pattern.matches(origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+// Filename: cmd/api/demo/cors/preflight/main.go
+
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+)
+
+// The JSON content type and the Authorization header make these requests
+// non-simple, so the browser sends a preflight OPTIONS request first
+const html = `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+</head>
+<body>
+<h1>Preflight CORS</h1>
+<div id="output"></div>
+<div id="sessions"></div>
+<script>
+document.addEventListener('DOMContentLoaded', function() {
+	fetch("http://localhost:4000/v1/tokens/authentication", {
+		method: "POST",
+		headers: {
+			'Content-Type': 'application/json'
+		},
+		body: JSON.stringify({
+			email: 'alice@example.com',
+			password: 'pa55word'
+		})
+	}).then(
+		function(response) {
+			response.json().then(function(body) {
+				document.getElementById("output").innerHTML=JSON.stringify(body);
+				if (!body.authentication_token) {
+					return;
+				}
+				// A second cross-origin request carrying the token
+				fetch("http://localhost:4000/v1/users/me/sessions", {
+					headers: {
+						'Authorization': 'Bearer ' + body.authentication_token.token
+					}
+				}).then(function(response) {
+					response.text().then(function(text) {
+						document.getElementById("sessions").innerHTML=text;
+					});
+				});
+			});
+		},
+		function(err) {
+			document.getElementById("output").innerHTML=err;
+		}
+	);
+});
+</script>
+</body>
+</html>
+`
+
+func main() {
+	addr := flag.String("addr", ":9000", "Server address")
+	flag.Parse()
+
+	log.Printf("starting server on %s", *addr)
+
+	err := http.ListenAndServe(*addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(html))
+	}))
+	log.Fatal(err)
+}
@@ -0,0 +1,70 @@
+// Filename: cmd/api/denylist.go
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The denylist keeps revoked signed token ids in memory so the authentication
+// middleware never has to ask the database. Other instances pick up entries
+// from the token_denylist table when they refresh
+type denylist struct {
+	mu      sync.RWMutex
+	entries map[string]time.Time
+}
+
+func newDenylist() *denylist {
+	return &denylist{entries: make(map[string]time.Time)}
+}
+
+// Check if a token id has been revoked
+func (d *denylist) Contains(jti string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, found := d.entries[jti]
+	return found
+}
+
+// Add a single entry without waiting for the next refresh
+func (d *denylist) Add(jti string, expiry time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[jti] = expiry
+}
+
+// Replace the entries with a fresh copy from the database, keeping local
+// entries that have not expired in case their insert has not landed yet
+func (d *denylist) Replace(entries map[string]time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for jti, expiry := range d.entries {
+		if _, found := entries[jti]; !found && expiry.After(now) {
+			entries[jti] = expiry
+		}
+	}
+	d.entries = entries
+}
+
+// revokeSignedToken() denies a signed token id on this instance and shares it
+// with the others through the database
+func (app *application) revokeSignedToken(jti string, expiry time.Time) error {
+	app.denylist.Add(jti, expiry)
+	return app.models.Denylist.Insert(jti, expiry)
+}
+
+// refreshDenylist() reloads the denylist from the database every interval
+func (app *application) refreshDenylist(interval time.Duration) {
+	go func() {
+		for {
+			entries, err := app.models.Denylist.GetAllActive()
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			} else {
+				app.denylist.Replace(entries)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
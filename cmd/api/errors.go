@@ -4,18 +4,24 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"time"
 )
 
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.PrintError(err, map[string]string{
+	app.requestLogger(r).PrintError(err, map[string]string{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
+		"client_ip":      app.clientIP(r),
 	})
 }
 
 // To send JSON-formatted error message
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
 	env := envelope{"error": message}
+	// Users can quote the id when they report the error
+	if id := requestID(r); id != "" {
+		env["request_id"] = id
+	}
 	err := app.writeJSON(w, status, env, nil)
 	if err != nil {
 		app.logError(r, err)
@@ -64,8 +70,29 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
 }
 
+// The record changed since the version the client named in If-Match
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the record has been modified since it was fetched, fetch it again and retry"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+// Another request with the same idempotency key has not finished yet
+func (app *application) idempotencyKeyInUseResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this idempotency key is still being processed, retry later"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// The idempotency key was first used for a different request
+func (app *application) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this idempotency key was already used with a different request"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
 // Rate limit error
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+	if app.metrics != nil {
+		app.metrics.rateLimited.Inc()
+	}
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
@@ -100,3 +127,52 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "Your user account does not have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+// An API key or OAuth token tried to create credentials
+func (app *application) restrictedCredentialResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this credential can't be used to create other credentials, sign in directly instead"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// Second factor already set up
+func (app *application) totpAlreadyEnabledResponse(w http.ResponseWriter, r *http.Request) {
+	message := "two-factor authentication is already enabled for this account"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// No key to encrypt secrets with was configured
+func (app *application) totpNotConfiguredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "two-factor authentication is not available on this server"
+	app.errorResponse(w, r, http.StatusNotImplemented, message)
+}
+
+// OAuth endpoints report errors in the shape RFC 6749 section 5.2 requires
+func (app *application) oauthErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	env := envelope{"error": code, "error_description": description}
+	err := app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// Unknown OAuth client or wrong secret
+func (app *application) invalidOAuthClientResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+}
+
+// Missing or mismatched CSRF token on a cookie-authenticated request
+func (app *application) invalidCSRFTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "missing or invalid CSRF token"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// The account is suspended, expiry is nil for a permanent ban
+func (app *application) accountSuspendedResponse(w http.ResponseWriter, r *http.Request, expiry *time.Time) {
+	message := "your user account has been suspended"
+	if expiry != nil {
+		message = fmt.Sprintf("your user account has been suspended until %s", expiry.UTC().Format(time.RFC3339))
+	}
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
@@ -0,0 +1,56 @@
+// Filename: cmd/api/etag.go
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// versionETag() turns a record version into an entity tag. Every change to
+// a record bumps its version, so the version alone identifies what a
+// client has seen. The tag is weak because the same version is sent gzipped,
+// compact or indented, and those bodies differ byte for byte
+func versionETag(version int32) string {
+	return `W/"` + strconv.FormatInt(int64(version), 10) + `"`
+}
+
+// etagListMatches() checks an If-Match or If-None-Match header against an
+// entity tag. A missing header never matches, "*" always does. Our tags are
+// all weak, so both headers compare them weakly: the versions must match
+func etagListMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified() reports whether the client already has this version of a
+// record, in which case a 304 has been sent
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" || !etagListMatches(header, etag) {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// preconditionFailed() reports whether an If-Match header names a version
+// other than the current one, in which case a 412 has been sent
+func (app *application) preconditionFailed(w http.ResponseWriter, r *http.Request, etag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" || etagListMatches(header, etag) {
+		return false
+	}
+	app.preconditionFailedResponse(w, r)
+	return true
+}
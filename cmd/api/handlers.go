@@ -28,12 +28,14 @@ func (app *application) createForumHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	//coping the valeus from the input struct to the new forum struct
+	author := app.contextGetUser(r)
 	forum := &data.Forum{
 		Title:       input.Title,
 		Category:    input.Category,
 		Description: input.Description,
 		Publisher:   input.Publisher,
 		ReleaseDate: input.ReleaseDate,
+		UserID:      &author.ID,
 	}
 
 	//Initialize a new Validator Instance
@@ -45,11 +47,23 @@ func (app *application) createForumHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	//Run the text past the content policy
+	result := app.checkContentPolicy(v, forumPolicyFields(forum))
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	//Creating a forum element
 	err = app.models.Forums.Insert(forum)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
 	}
+	app.audit(r, "forum.create", "forum", forum.ID, nil, forum)
+
+	//Held or flagged forums go to the moderators
+	app.queueForPolicy(r, forum, result)
 
 	//Create a location header for the newly created resource
 	headers := make(http.Header)
@@ -84,8 +98,29 @@ func (app *application) showForumHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	//Hidden forums are only shown to their moderators
+	if forum.Hidden {
+		permitted, err := app.hasForumPermission(r, forum.ID, "forum:moderate")
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !permitted {
+			app.notFoundReponse(w, r)
+			return
+		}
+	}
+
+	//Clients that already have this version get an empty 304
+	etag := versionETag(forum.Version)
+	if notModified(w, r, etag) {
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+
 	//Writing the data from the returned get()
-	err = app.writeJSON(w, http.StatusOK, envelope{"forum": forum}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"forum": forum}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -113,6 +148,14 @@ func (app *application) updateForumHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	//Refuse the update before reading it if the client edited an old version
+	if app.preconditionFailed(w, r, versionETag(forum.Version)) {
+		return
+	}
+
+	//Keep a copy of the original for the audit log
+	original := *forum
+
 	//Creating an input struct to hold data read in from the client
 	//Updating the input struct to use pointers because pointers have a default value of nil
 	var input struct {
@@ -160,10 +203,20 @@ func (app *application) updateForumHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	//Passing the updated forum element to the update() method
+	//Run the text past the content policy
+	result := app.checkContentPolicy(v, forumPolicyFields(forum))
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//Passing the updated forum element to the update() method. It only
+	//applies to the version fetched above, which If-Match has checked
 	err = app.models.Forums.Update(forum)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrEditConflict) && r.Header.Get("If-Match") != "":
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -171,9 +224,15 @@ func (app *application) updateForumHandler(w http.ResponseWriter, r *http.Reques
 		}
 		return
 	}
+	app.audit(r, "forum.update", "forum", forum.ID, original, forum)
 
-	//Writing the data returned by Get()
-	err = app.writeJSON(w, http.StatusOK, envelope{"forum": forum}, nil)
+	//Held or flagged forums go to the moderators
+	app.queueForPolicy(r, forum, result)
+
+	//Writing the data returned by Get() along with its new version
+	headers := make(http.Header)
+	headers.Set("ETag", versionETag(forum.Version))
+	err = app.writeJSON(w, http.StatusOK, envelope{"forum": forum}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -187,8 +246,8 @@ func (app *application) deleteForumHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Forums.Delete(id)
-
+	//Fetch the record first so the audit log has what was deleted
+	forum, err := app.models.Forums.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -199,6 +258,26 @@ func (app *application) deleteForumHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	//Refuse to delete a version the client has not seen
+	if app.preconditionFailed(w, r, versionETag(forum.Version)) {
+		return
+	}
+
+	//Only the version fetched above is deleted
+	err = app.models.Forums.Delete(forum.ID, forum.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict) && r.Header.Get("If-Match") != "":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.audit(r, "forum.delete", "forum", id, forum, nil)
+
 	//Returning 200 status ok to the client with a success message
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "forum element sucessfully deleted"}, nil)
 	if err != nil {
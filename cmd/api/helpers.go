@@ -2,15 +2,20 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"forum.kevin.net/internal/data"
 	"forum.kevin.net/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
@@ -30,8 +35,15 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 }
 
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-	// Convert our map into a JSON object
-	js, err := json.MarshalIndent(data, "", "\t")
+	// Convert our map into a JSON object, indented unless the client asked
+	// for compact JSON
+	var js []byte
+	var err error
+	if compactJSONRequested(w) {
+		js, err = json.Marshal(data)
+	} else {
+		js, err = json.MarshalIndent(data, "", "\t")
+	}
 	if err != nil {
 		return err
 	}
@@ -146,9 +158,100 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return intValue
 }
 
+// The readTime() method reads an RFC 3339 time from the query string. A missing
+// value is the zero time and a malformed one adds a validation error
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) time.Time {
+	value := qs.Get(key)
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 time")
+		return time.Time{}
+	}
+	return t
+}
+
+// permissionsFor() returns what the request may do: the permissions resolved
+// while authenticating if there are any, from a restricted credential or the
+// claims of a signed token, else all of the user's
+func (app *application) permissionsFor(r *http.Request, user *data.User) (data.Permissions, error) {
+	if permissions, ok := app.contextGetPermissions(r); ok {
+		return permissions, nil
+	}
+	return app.models.Permissions.GetAllForUser(user.ID)
+}
+
+// hasForumPermission() checks the request's user for a code, either globally
+// or scoped to one forum
+func (app *application) hasForumPermission(r *http.Request, forumID int64, code string) (bool, error) {
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return false, nil
+	}
+	permissions, err := app.permissionsFor(r, user)
+	if err != nil {
+		return false, err
+	}
+	// A global grant covers every forum
+	if permissions.Include(code) {
+		return true, nil
+	}
+	if app.contextRestricted(r) {
+		return false, nil
+	}
+	return app.models.Permissions.IncludeForForum(user.ID, forumID, code)
+}
+
+// clientIP() returns the IP address of the client that sent the request, as
+// resolved by the realIP middleware
+func (app *application) clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// validRequestID() only accepts ids that are safe to log and echo back
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.:", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID() generates a random request id
+func newRequestID() string {
+	b := make([]byte, 16)
+	// crypto/rand only fails if the system's source of randomness does
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
 // background accepts a function as its parameter
 func (app *application) background(fn func()) {
+	if app.metrics != nil {
+		app.metrics.background.Inc()
+	}
 	go func() {
+		if app.metrics != nil {
+			defer app.metrics.background.Dec()
+		}
 		//Recovery from panics
 		defer func() {
 			if err := recover(); err != nil {
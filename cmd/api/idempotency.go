@@ -0,0 +1,141 @@
+// Filename: cmd/api/idempotency.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+
+	"forum.kevin.net/internal/data"
+	"forum.kevin.net/internal/validator"
+)
+
+// The header clients send to make a POST safe to retry
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Response headers stored with a key and replayed, the rest describe the
+// retry rather than the original request
+var idempotentHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// An idempotencyRecorder passes a response through while keeping a copy
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status != 0 {
+		return
+	}
+	rec.status = status
+	for _, name := range idempotentHeaders {
+		if values := rec.Header().Values(name); len(values) > 0 {
+			rec.header[name] = values
+		}
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap() lets http.ResponseController reach the real writer
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// idempotent() makes POST requests to a route safe to retry when they carry
+// an Idempotency-Key header. The first request with a key is served and its
+// response stored, retries get that response back without running the
+// handler again. Keys belong to users, so only authenticated requests take
+// part. Responses are stored as they are, so it must never wrap a route
+// that hands out secrets such as API keys, OAuth clients or TOTP enrollments.
+// Grants are left out too, repeating them changes nothing anyway
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		user := app.contextGetUser(r)
+		if r.Method != http.MethodPost || key == "" || user.IsAnonymous() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		v := validator.New()
+		if data.ValidateIdempotencyKey(v, key); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+		// The fingerprint tells a retry from a different request reusing
+		// the key. The body is read here, so hand the handler a copy
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		io.WriteString(hash, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery+"\n")
+		hash.Write(body)
+		fingerprint := hash.Sum(nil)
+
+		entry, reserved, err := app.models.IdempotencyKeys.Reserve(user.ID, key, fingerprint, app.config.idempotency.ttl)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.idempotencyKeyInUseResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		if !reserved {
+			switch {
+			case !bytes.Equal(entry.Fingerprint, fingerprint):
+				app.idempotencyKeyMismatchResponse(w, r)
+			case entry.Status == 0:
+				app.idempotencyKeyInUseResponse(w, r)
+			default:
+				for name, values := range entry.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(entry.Status)
+				w.Write(entry.Body)
+			}
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w, header: make(http.Header)}
+		completed := false
+		// Server errors and panics give the key back so the client can retry
+		defer func() {
+			if completed {
+				return
+			}
+			err := app.models.IdempotencyKeys.Release(entry)
+			if err != nil {
+				app.requestLogger(r).PrintError(err, map[string]string{"idempotency_key": key})
+			}
+		}()
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 || rec.status >= 500 {
+			return
+		}
+		err = app.models.IdempotencyKeys.Complete(entry, rec.status, rec.header, rec.body.Bytes())
+		if err != nil {
+			// The response has been sent, a retry will just run again
+			app.requestLogger(r).PrintError(err, map[string]string{"idempotency_key": key})
+			return
+		}
+		completed = true
+	}
+}
@@ -4,6 +4,8 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"os"
 	"strings"
@@ -11,7 +13,11 @@ import (
 
 	"forum.kevin.net/internal/data"
 	"forum.kevin.net/internal/jsonlog"
+	"forum.kevin.net/internal/jwt"
 	"forum.kevin.net/internal/mailer"
+	"forum.kevin.net/internal/policy"
+	"forum.kevin.net/internal/realip"
+	"forum.kevin.net/internal/validator"
 
 	_ "github.com/lib/pq"
 )
@@ -27,9 +33,14 @@ type config struct {
 		MaxIdleTime  string
 	}
 	limiter struct {
-		rps     float64 // requests/second
-		burst   int
-		enabled bool
+		rps       float64 // requests/second
+		burst     int
+		ipRPS     float64 // per address, for requests whose credentials fail
+		ipBurst   int
+		authRPS   float64 // for signing in, signing up and token requests
+		authBurst int
+		store     string // memory or postgres
+		enabled   bool
 	}
 	smtp struct {
 		host     string
@@ -39,7 +50,61 @@ type config struct {
 		sender   string
 	}
 	cors struct {
-		trustedOrigins []string
+		trustedOrigins []originPattern
+		credentials    bool // also implied by session cookies
+		maxAge         time.Duration
+	}
+	trustedProxies []string // networks whose forwarding headers are believed
+	proxyHeader    string   // the one forwarding header those proxies set
+	metricsAddr    string   // empty to disable the metrics listener
+	compress       struct {
+		enabled bool
+		minSize int // smaller responses are sent as they are
+		types   map[string]bool
+	}
+	accessLog struct {
+		enabled    bool
+		sampleRate float64 // share of successful requests logged
+		skipRoutes map[string]bool
+	}
+	session struct {
+		enabled  bool // allow browser clients to use cookies instead of bearer tokens
+		secure   bool
+		sameSite string
+	}
+	tokens struct {
+		accessTTL   time.Duration
+		refreshTTL  time.Duration
+		mode        string // database or signed
+		signingKeys string
+	}
+	maintenance struct {
+		interval          time.Duration
+		batchSize         int
+		unactivatedMaxAge time.Duration
+	}
+	totp struct {
+		key    []byte // AES-256 key used to encrypt stored secrets, none disables enrollment
+		issuer string
+	}
+	cache struct {
+		enabled    bool
+		ttl        time.Duration
+		maxEntries int
+	}
+	idempotency struct {
+		ttl time.Duration // how long responses are kept for retries
+	}
+	roles struct {
+		defaultRole string // given to every new signup
+	}
+	policy struct {
+		wordsFile      string
+		wordsAction    string
+		maxLinks       int // negative to allow any number
+		linksAction    string
+		blockedDomains []string
+		domainsAction  string
 	}
 }
 
@@ -48,10 +113,17 @@ const version = "1.0.0"
 
 // Dependency Injections
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
+	config        config
+	logger        *jsonlog.Logger
+	models        data.Models
+	mailer        mailer.Mailer
+	signingKeys   *jwt.KeySet
+	denylist      *denylist
+	maintenance   *maintenance
+	contentPolicy *policy.Policy
+	limiter       *rateLimiter
+	ipResolver    *realip.Resolver
+	metrics       *appMetrics
 }
 
 // main
@@ -67,6 +139,11 @@ func main() {
 	// These are flags for the rate limiter
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	flag.Float64Var(&cfg.limiter.ipRPS, "limiter-ip-rps", 4, "Rate limiter maximum failed authentications per second per IP address")
+	flag.IntVar(&cfg.limiter.ipBurst, "limiter-ip-burst", 8, "Rate limiter maximum burst of failed authentications per IP address")
+	flag.Float64Var(&cfg.limiter.authRPS, "limiter-auth-rps", 0.2, "Rate limiter maximum requests per second for authentication routes")
+	flag.IntVar(&cfg.limiter.authBurst, "limiter-auth-burst", 5, "Rate limiter maximum burst for authentication routes")
+	flag.StringVar(&cfg.limiter.store, "limiter-store", "memory", "Where rate limits are kept (memory | postgres)")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 	//These are flags for the mailer
 	flag.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
@@ -74,15 +151,132 @@ func main() {
 	flag.StringVar(&cfg.smtp.username, "smtp-username", "0aa06d58302a21", "SMTP username")
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "6812fc9deed328", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "OnlyGamersForum <no-reply@forums.kevin.net>", "SMTP sender")
-	// Use flag.func() function to parse our trusted origins flag from a tring to a slice of strings
-	flag.Func("cors-trusted-origin", "Trusted CORS origin (space seperated)", func(val string) error {
-		cfg.cors.trustedOrigins = strings.Fields(val)
+	// Use flag.func() function to parse our trusted origins flag from a tring to a slice of patterns
+	flag.Func("cors-trusted-origin", "Trusted CORS origins, https://*.example.com matches subdomains (space seperated)", func(val string) error {
+		cfg.cors.trustedOrigins = nil
+		for _, origin := range strings.Fields(val) {
+			pattern, err := parseOriginPattern(origin)
+			if err != nil {
+				return err
+			}
+			cfg.cors.trustedOrigins = append(cfg.cors.trustedOrigins, pattern)
+		}
 		return nil
 	})
+	flag.BoolVar(&cfg.cors.credentials, "cors-credentials", false, "Let trusted origins send cookies and authorization headers with credentials mode")
+	flag.DurationVar(&cfg.cors.maxAge, "cors-max-age", 10*time.Minute, "How long browsers may cache a preflight response")
+	flag.Func("trusted-proxies", "Proxy addresses or CIDR networks allowed to set forwarding headers (space seperated)", func(val string) error {
+		cfg.trustedProxies = strings.Fields(val)
+		return nil
+	})
+	flag.StringVar(&cfg.proxyHeader, "trusted-proxy-header", "X-Forwarded-For", "Forwarding header set by the trusted proxies, no other is read (Forwarded | X-Forwarded-For | X-Real-IP)")
+	flag.StringVar(&cfg.metricsAddr, "metrics-addr", "localhost:4001", "Address of the Prometheus metrics listener (empty to disable)")
+	// These are flags for response compression
+	flag.BoolVar(&cfg.compress.enabled, "compress-enabled", true, "Gzip responses for clients that accept it")
+	flag.IntVar(&cfg.compress.minSize, "compress-min-size", 1024, "Minimum response size in bytes worth compressing")
+	cfg.compress.types = map[string]bool{"application/json": true, "text/plain": true, "text/html": true}
+	flag.Func("compress-types", "Content types that are compressed (space seperated, default \"application/json text/plain text/html\")", func(val string) error {
+		cfg.compress.types = make(map[string]bool)
+		for _, contentType := range strings.Fields(val) {
+			cfg.compress.types[strings.ToLower(contentType)] = true
+		}
+		return nil
+	})
+	// These are flags for the access log
+	flag.BoolVar(&cfg.accessLog.enabled, "access-log-enabled", true, "Log every request served")
+	flag.Float64Var(&cfg.accessLog.sampleRate, "access-log-sample-rate", 1, "Share of successful requests logged, failures are always logged (0 to 1)")
+	cfg.accessLog.skipRoutes = map[string]bool{"/v1/healthcheck": true}
+	flag.Func("access-log-skip", "Route patterns never logged (space seperated, default \"/v1/healthcheck\")", func(val string) error {
+		cfg.accessLog.skipRoutes = make(map[string]bool)
+		for _, route := range strings.Fields(val) {
+			cfg.accessLog.skipRoutes[route] = true
+		}
+		return nil
+	})
+	// These are flags for cookie-based sessions
+	flag.BoolVar(&cfg.session.enabled, "session-cookies", false, "Allow browser clients to authenticate with session cookies")
+	flag.BoolVar(&cfg.session.secure, "session-cookie-secure", true, "Only send session cookies over HTTPS")
+	flag.StringVar(&cfg.session.sameSite, "session-cookie-samesite", "lax", "SameSite mode of session cookies (lax | strict | none)")
+	// These are flags for token lifetimes
+	flag.DurationVar(&cfg.tokens.accessTTL, "token-access-ttl", 15*time.Minute, "Authentication (access) token lifetime")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "token-refresh-ttl", 30*24*time.Hour, "Refresh token lifetime")
+	flag.StringVar(&cfg.tokens.mode, "token-mode", "database", "Access token mode (database | signed)")
+	flag.StringVar(&cfg.tokens.signingKeys, "token-signing-keys", os.Getenv("TESTFORUM_TOKEN_SIGNING_KEYS"), "Ed25519 signing keys as kid=base64url(seed), first one signs (space seperated)")
+	// These are flags for the maintenance worker
+	flag.DurationVar(&cfg.maintenance.interval, "maintenance-interval", time.Hour, "How often expired rows are cleaned up")
+	flag.IntVar(&cfg.maintenance.batchSize, "maintenance-batch-size", 1000, "Maximum rows deleted per statement")
+	flag.DurationVar(&cfg.maintenance.unactivatedMaxAge, "maintenance-unactivated-max-age", 7*24*time.Hour, "Age after which unactivated accounts are deleted")
+	// These are flags for two-factor authentication
+	// The key is checked once flags are parsed, whichever way it was given
+	totpKey := os.Getenv("TESTFORUM_TOTP_KEY")
+	flag.Func("totp-key", "Hex encoded 32-byte key used to encrypt TOTP secrets, two-factor enrollment is off without one (default $TESTFORUM_TOTP_KEY)", func(val string) error {
+		totpKey = val
+		return nil
+	})
+	flag.StringVar(&cfg.totp.issuer, "totp-issuer", "OnlyGamersForum", "Issuer name shown in authenticator apps")
+	// These are flags for the authentication cache
+	flag.BoolVar(&cfg.cache.enabled, "auth-cache-enabled", true, "Cache token and permission lookups in memory")
+	flag.DurationVar(&cfg.cache.ttl, "auth-cache-ttl", 30*time.Second, "How long cached lookups are trusted")
+	flag.IntVar(&cfg.cache.maxEntries, "auth-cache-max-entries", 10000, "Maximum cached tokens and users")
+	flag.DurationVar(&cfg.idempotency.ttl, "idempotency-key-ttl", 24*time.Hour, "How long a POST with an Idempotency-Key can be retried")
+	flag.StringVar(&cfg.roles.defaultRole, "default-role", "member", "Role given to new users (member | moderator | admin)")
+	// These are flags for the content policy, actions are flag, hold or reject
+	flag.StringVar(&cfg.policy.wordsFile, "policy-words-file", "", "File of blocked words, one per line")
+	flag.StringVar(&cfg.policy.wordsAction, "policy-words-action", "reject", "Action for text containing a blocked word")
+	flag.IntVar(&cfg.policy.maxLinks, "policy-max-links", 3, "Maximum links in a piece of text (-1 for no limit)")
+	flag.StringVar(&cfg.policy.linksAction, "policy-links-action", "hold", "Action for text with too many links")
+	flag.Func("policy-blocked-domains", "Domains that may not be linked to (space seperated)", func(val string) error {
+		cfg.policy.blockedDomains = strings.Fields(val)
+		return nil
+	})
+	flag.StringVar(&cfg.policy.domainsAction, "policy-domains-action", "reject", "Action for text linking to a blocked domain")
 
 	flag.Parse()
 	// Create a logger
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	if cfg.maintenance.interval <= 0 || cfg.maintenance.batchSize < 1 {
+		logger.PrintFatal(errors.New("maintenance interval and batch size must be positive"), nil)
+	}
+	if cfg.accessLog.sampleRate < 0 || cfg.accessLog.sampleRate > 1 {
+		logger.PrintFatal(errors.New("access log sample rate must be between 0 and 1"), nil)
+	}
+	if totpKey != "" {
+		key, err := hex.DecodeString(totpKey)
+		if err != nil || len(key) != 32 {
+			logger.PrintFatal(errors.New("TOTP key must be 64 hexadecimal characters"), nil)
+		}
+		cfg.totp.key = key
+	}
+	if cfg.idempotency.ttl <= 0 {
+		logger.PrintFatal(errors.New("idempotency key TTL must be positive"), nil)
+	}
+	if cfg.cache.enabled && (cfg.cache.ttl <= 0 || cfg.cache.maxEntries < 1) {
+		logger.PrintFatal(errors.New("auth cache TTL and max entries must be positive"), nil)
+	}
+	switch {
+	case !validator.In(cfg.session.sameSite, "lax", "strict", "none"):
+		logger.PrintFatal(errors.New("session cookie SameSite mode must be lax, strict or none"), nil)
+	case cfg.session.sameSite == "none" && !cfg.session.secure:
+		logger.PrintFatal(errors.New("SameSite=None session cookies must be secure"), nil)
+	}
+	// Build the content policy
+	contentPolicy, err := newContentPolicy(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	// Work out which proxies may tell us the client's address
+	ipResolver, err := realip.New(cfg.trustedProxies, cfg.proxyHeader)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	// Load the keys used for signed access tokens
+	signingKeys, err := jwt.ParseKeySet(cfg.tokens.signingKeys)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	if cfg.tokens.mode == "signed" && signingKeys.Len() == 0 {
+		logger.PrintFatal(errors.New("signed token mode requires at least one signing key"), nil)
+	}
 	// Create the connection pool
 	db, err := openDB(cfg)
 	if err != nil {
@@ -92,13 +286,43 @@ func main() {
 	defer db.Close()
 	// Log the successful connection pool
 	logger.PrintInfo("database connection pool established", nil)
+	// Build the rate limiter, the postgres store needs the pool
+	limiter, err := newRateLimiter(cfg, db)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	// The cache stays nil, and so disabled, unless asked for
+	var authCache *data.AuthCache
+	if cfg.cache.enabled {
+		authCache = data.NewAuthCache(cfg.cache.maxEntries, cfg.cache.ttl)
+	}
 	// Create an instance of our application struct
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:        cfg,
+		logger:        logger,
+		models:        data.NewModels(db, authCache),
+		mailer:        mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		signingKeys:   signingKeys,
+		denylist:      newDenylist(),
+		contentPolicy: contentPolicy,
+		limiter:       limiter,
+		ipResolver:    ipResolver,
+		metrics:       newMetrics(db, authCache),
+	}
+	// Refuse to start if signups would be given a role that does not exist
+	exists, err := app.models.Roles.Exists(cfg.roles.defaultRole)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	if !exists {
+		logger.PrintFatal(errors.New("default role does not exist"), map[string]string{"role": cfg.roles.defaultRole})
+	}
+	// Keep the signed token denylist in step with other instances
+	if cfg.tokens.mode == "signed" {
+		app.refreshDenylist(30 * time.Second)
 	}
+	// Start cleaning up expired rows, serve() stops it on shutdown
+	app.startMaintenance()
 	// Call app.serve() to start the server
 	err = app.serve()
 	if err != nil {
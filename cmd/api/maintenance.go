@@ -0,0 +1,107 @@
+// Filename: cmd/api/maintenance.go
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"forum.kevin.net/internal/ratelimit"
+)
+
+// The maintenance worker periodically removes rows nobody needs any more
+type maintenance struct {
+	quit chan struct{}
+	done chan struct{}
+}
+
+// A maintenanceTask deletes one kind of row in batches
+type maintenanceTask struct {
+	name  string
+	purge func(batchSize int) (int64, error)
+}
+
+// startMaintenance() launches the worker. It runs once straight away and
+// then every configured interval until stopMaintenance() is called
+func (app *application) startMaintenance() {
+	app.maintenance = &maintenance{
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(app.maintenance.done)
+		ticker := time.NewTicker(app.config.maintenance.interval)
+		defer ticker.Stop()
+		for {
+			app.runMaintenance()
+			select {
+			case <-ticker.C:
+			case <-app.maintenance.quit:
+				return
+			}
+		}
+	}()
+}
+
+// stopMaintenance() asks the worker to stop and waits for the current run to finish
+func (app *application) stopMaintenance() {
+	if app.maintenance == nil {
+		return
+	}
+	close(app.maintenance.quit)
+	<-app.maintenance.done
+	app.logger.PrintInfo("stopped maintenance worker", nil)
+}
+
+// runMaintenance() performs a single pass and logs what it removed
+func (app *application) runMaintenance() {
+	defer func() {
+		if err := recover(); err != nil {
+			app.logger.PrintError(fmt.Errorf("%s", err), nil)
+		}
+	}()
+	start := time.Now()
+	cutoff := start.Add(-app.config.maintenance.unactivatedMaxAge)
+
+	tasks := []maintenanceTask{
+		{"expired_tokens", app.models.Tokens.DeleteExpired},
+		{"expired_denylist_entries", app.models.Denylist.DeleteExpired},
+		{"expired_authorization_codes", app.models.OAuthCodes.DeleteExpired},
+		{"expired_idempotency_keys", app.models.IdempotencyKeys.DeleteExpired},
+		{"unactivated_users", func(batchSize int) (int64, error) {
+			return app.models.Users.DeleteUnactivatedBefore(cutoff, batchSize)
+		}},
+	}
+	// Limits kept in memory clean up after themselves
+	if store, ok := app.limiter.store.(ratelimit.PostgresStore); ok {
+		tasks = append(tasks, maintenanceTask{"expired_rate_limits", store.DeleteExpired})
+	}
+	properties := make(map[string]string)
+	for _, task := range tasks {
+		total, err := app.purgeInBatches(task.purge)
+		properties[task.name] = strconv.FormatInt(total, 10)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"task": task.name})
+		}
+	}
+	properties["duration"] = time.Since(start).String()
+	app.logger.PrintInfo("maintenance run completed", properties)
+}
+
+// purgeInBatches() keeps deleting until a batch comes back short or the
+// worker is asked to stop, so one run never holds locks for long
+func (app *application) purgeInBatches(purge func(batchSize int) (int64, error)) (int64, error) {
+	var total int64
+	for {
+		n, err := purge(app.config.maintenance.batchSize)
+		total += n
+		if err != nil || n < int64(app.config.maintenance.batchSize) {
+			return total, err
+		}
+		select {
+		case <-app.maintenance.quit:
+			return total, nil
+		default:
+		}
+	}
+}
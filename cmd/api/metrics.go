@@ -0,0 +1,97 @@
+// Filename: cmd/api/metrics.go
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"forum.kevin.net/internal/data"
+	"forum.kevin.net/internal/metrics"
+)
+
+// The application's metrics, served in the Prometheus format on their own
+// listener so they are never exposed with the API
+type appMetrics struct {
+	registry    *metrics.Registry
+	requests    *metrics.CounterVec
+	durations   *metrics.HistogramVec
+	rateLimited *metrics.Counter
+	background  *metrics.Gauge
+	mail        *metrics.CounterVec
+}
+
+// newMetrics() registers every metric, including the connection pool's and
+// the authentication cache's
+func newMetrics(db *sql.DB, authCache *data.AuthCache) *appMetrics {
+	reg := metrics.NewRegistry()
+	m := &appMetrics{
+		registry:    reg,
+		requests:    reg.NewCounterVec("http_requests_total", "Requests served by route and status.", "method", "route", "status"),
+		durations:   reg.NewHistogramVec("http_request_duration_seconds", "Time taken to serve requests by route.", metrics.DefaultBuckets, "method", "route"),
+		rateLimited: reg.NewCounter("http_rate_limited_total", "Requests refused by the rate limiter."),
+		background:  reg.NewGauge("background_goroutines", "Background goroutines still running."),
+		mail:        reg.NewCounterVec("mail_sent_total", "Emails sent by result.", "result"),
+	}
+	// Each value reads the pool statistics afresh when scraped
+	stat := func(fn func(s sql.DBStats) float64) func() float64 {
+		return func() float64 { return fn(db.Stats()) }
+	}
+	reg.NewGaugeFunc("db_max_open_connections", "Maximum open database connections.", stat(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	reg.NewGaugeFunc("db_open_connections", "Open database connections.", stat(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	reg.NewGaugeFunc("db_in_use_connections", "Database connections in use.", stat(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	reg.NewGaugeFunc("db_idle_connections", "Idle database connections.", stat(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	reg.NewCounterFunc("db_wait_count_total", "Times a request waited for a database connection.", stat(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	reg.NewCounterFunc("db_wait_duration_seconds_total", "Time spent waiting for database connections.", stat(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	reg.NewCounterFunc("db_max_idle_closed_total", "Connections closed because of the idle connection limit.", stat(func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }))
+	reg.NewCounterFunc("db_max_idle_time_closed_total", "Connections closed because they were idle too long.", stat(func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }))
+	reg.NewCounterFunc("db_max_lifetime_closed_total", "Connections closed because they reached their maximum lifetime.", stat(func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }))
+	// The cache counters are read the same way, a disabled cache reads as zero
+	for _, kind := range []string{"session", "permission"} {
+		kind := kind
+		cacheStat := func(name string) func() float64 {
+			return func() float64 { return float64(authCache.Stats()[kind+"_"+name]) }
+		}
+		reg.NewCounterFunc("auth_cache_"+kind+"_hits_total", "Authentication cache "+kind+" lookups answered from memory.", cacheStat("hits"))
+		reg.NewCounterFunc("auth_cache_"+kind+"_misses_total", "Authentication cache "+kind+" lookups that went to the database.", cacheStat("misses"))
+		reg.NewCounterFunc("auth_cache_"+kind+"_evictions_total", "Authentication cache "+kind+" entries evicted to make room.", cacheStat("evictions"))
+		reg.NewGaugeFunc("auth_cache_"+kind+"_entries", "Authentication cache "+kind+" entries held.", cacheStat("entries"))
+	}
+	return m
+}
+
+// observeRequest() counts a served request. The metrics are nil until
+// main() creates them, so this does nothing before then
+func (m *appMetrics) observeRequest(r *http.Request, route string, status int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	method := metricMethod(r.Method)
+	m.requests.With(method, route, strconv.Itoa(status)).Inc()
+	m.durations.With(method, route).Observe(duration.Seconds())
+}
+
+// metricMethod() labels any method outside the standard ones as "other", so
+// clients can't create a new series per made up method
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// sendMail() sends an email and counts whether it went
+func (app *application) sendMail(recipient, templateFile string, data interface{}) error {
+	err := app.mailer.Send(recipient, templateFile, data)
+	if app.metrics != nil {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		app.metrics.mail.With(result).Inc()
+	}
+	return err
+}
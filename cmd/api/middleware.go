@@ -5,17 +5,36 @@ package main
 import (
 	"errors"
 	"fmt"
-	"net"
 	"net/http"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"forum.kevin.net/internal/data"
+	"forum.kevin.net/internal/jwt"
 	"forum.kevin.net/internal/validator"
-	"golang.org/x/time/rate"
 )
 
+// The header carrying request ids, and the longest id accepted from a client
+const (
+	requestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 128
+)
+
+// assignRequestID() gives every request an id, keeping the one a client or
+// proxy sent if it looks sane. The id is echoed in the response so users
+// can quote it, and is added to every log entry made for the request
+func (app *application) assignRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -28,64 +47,45 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	// Create a client type
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
+// realIP() works out the address of the client once, looking past trusted
+// proxies, so every later use agrees on it
+func (app *application) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = app.contextSetClientIP(r, app.ipResolver.ClientIP(r))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticationFailed() answers a request whose credentials were rejected.
+// Failures count against the client's address, so made up credentials can't
+// be sent endlessly, while signed in users behind a shared address are only
+// limited by who they are. Once the address runs out it gets a 429 instead
+func (app *application) authenticationFailed(w http.ResponseWriter, r *http.Request) {
+	if app.checkRateLimit(w, r, "ip", "ip:"+app.clientIP(r)) {
+		app.invalidAuthenticationTokenResponse(w, r)
 	}
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
-	// Launch a backaground Goroutine that removes old entries
-	// from the clients map once every minute
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			// Lock before starting to cleanup
-			mu.Lock()
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
-			}
-			mu.Unlock()
-		}
-	}()
+}
 
+// rateLimit() applies the default policy to every request. It runs after
+// authentication so signed in users are limited by who they are
+func (app *application) rateLimit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if app.config.limiter.enabled {
-			// Get the IP address of the request
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				app.serverErrorResponse(w, r, err)
-				return
-			}
-			// Lock()
-			mu.Lock()
-			// Check if the IP address is in the map
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{limiter: rate.NewLimiter(
-					rate.Limit(app.config.limiter.rps),
-					app.config.limiter.burst,
-				)}
-			}
-			// Update the last seen time of the client
-			clients[ip].lastSeen = time.Now()
-			// Check if request allowed
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
-				return
-			}
-
-			mu.Unlock()
-		} // end of enabled conditional
-		next.ServeHTTP(w, r)
+		if app.checkRateLimit(w, r, "default", app.rateLimitKey(r)) {
+			next.ServeHTTP(w, r)
+		}
 	})
 }
 
+// limitRoute() applies a stricter policy to a single route, on top of the
+// default one
+func (app *application) limitRoute(policy string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.checkRateLimit(w, r, policy, app.rateLimitKey(r)) {
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
 // Authentication Middleware
 func (app *application) authentication(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -93,6 +93,19 @@ func (app *application) authentication(next http.Handler) http.Handler {
 		w.Header().Add("Vary", "Authorization")
 		//Retrieve the value
 		authorizationHeader := r.Header.Get("Authorization")
+		//Browser clients in session mode send the token in a cookie instead
+		if authorizationHeader == "" && app.config.session.enabled {
+			w.Header().Add("Vary", "Cookie")
+			if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+				//Cookies are sent automatically, so unsafe requests must prove
+				//they came from our frontend
+				if !safeMethod(r.Method) && !app.validCSRF(r) {
+					app.invalidCSRFTokenResponse(w, r)
+					return
+				}
+				authorizationHeader = "Bearer " + cookie.Value
+			}
+		}
 		//If no authentication then it's an anonymous user
 		if authorizationHeader == "" {
 			r = app.contextSetUser(r, data.AnonymousUser)
@@ -101,8 +114,23 @@ func (app *application) authentication(next http.Handler) http.Handler {
 		}
 		//Check authorizationHeader format
 		headerParts := strings.Split(authorizationHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-			app.invalidAuthenticationTokenResponse(w, r)
+		//OAuth clients send their credentials with Basic auth, which the
+		//token endpoints check themselves. Nobody is signed in by it
+		if len(headerParts) == 2 && headerParts[0] == "Basic" {
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(headerParts) != 2 || (headerParts[0] != "Bearer" && headerParts[0] != "ApiKey") {
+			app.authenticationFailed(w, r)
+			return
+		}
+		//API keys use their own scheme
+		if headerParts[0] == "ApiKey" {
+			r, ok := app.authenticateAPIKey(w, r, headerParts[1])
+			if ok {
+				next.ServeHTTP(w, r)
+			}
 			return
 		}
 		//Extract the token
@@ -110,28 +138,148 @@ func (app *application) authentication(next http.Handler) http.Handler {
 		//Validate the token
 		v := validator.New()
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
-			app.invalidAuthenticationTokenResponse(w, r)
+			app.authenticationFailed(w, r)
 			return
 		}
 
+		//Signed tokens are verified without a database lookup
+		if app.config.tokens.mode == "signed" && jwt.Looks(token) {
+			r, ok := app.authenticateSignedToken(r, token)
+			if !ok {
+				app.authenticationFailed(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
 		//Retrieve dials about user
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, session, err := app.models.Users.GetForAuthenticationToken(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
-				app.invalidAuthenticationTokenResponse(w, r)
+				app.authenticationFailed(w, r)
 			default:
 				app.serverErrorResponse(w, r, err)
 			}
 			return
 		}
+		if user.Suspended {
+			app.accountSuspendedResponse(w, r, nil)
+			return
+		}
+		// Only write last_used_at once a minute and off the request path
+		if time.Since(session.LastUsedAt) > time.Minute {
+			app.background(func() {
+				err := app.models.Tokens.Touch(session)
+				if err != nil {
+					app.requestLogger(r).PrintError(err, nil)
+				}
+			})
+		}
+		// Tokens issued to OAuth clients only carry the scopes the user consented to
+		if session.Permissions != nil {
+			permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			r = app.contextSetPermissions(r, permissions.Intersect(session.Permissions))
+			r = app.contextSetRestricted(r)
+		}
 		// Add the user information to the request context
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, session)
 		// Call the next handler
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticateSignedToken() verifies a signed access token and adds the user
+// and permissions from its claims to the request context
+func (app *application) authenticateSignedToken(r *http.Request, token string) (*http.Request, bool) {
+	claims, err := app.signingKeys.Verify(token, time.Now())
+	if err != nil {
+		return r, false
+	}
+	// Check that the token was not revoked
+	if app.denylist.Contains(claims.ID) {
+		return r, false
+	}
+	sessionID, err := strconv.ParseInt(claims.ID, 10, 64)
+	if err != nil {
+		return r, false
+	}
+	user := &data.User{
+		ID:        claims.Subject,
+		Email:     claims.Email,
+		Activated: claims.Activated,
+	}
+	session := &data.Token{
+		ID:     sessionID,
+		UserID: claims.Subject,
+		Expiry: time.Unix(claims.Expiry, 0),
+		Scope:  data.ScopeAuthentication,
+	}
+	if claims.ClientID != 0 {
+		session.ClientID = &claims.ClientID
+	}
+	r = app.contextSetUser(r, user)
+	r = app.contextSetToken(r, session)
+	r = app.contextSetPermissions(r, data.Permissions(claims.Permissions))
+	// Only tokens issued to OAuth clients are limited to what was consented to
+	if claims.ClientID != 0 {
+		r = app.contextSetRestricted(r)
+	}
+	return r, true
+}
+
+// authenticateAPIKey() looks up an API key and adds its owner and the key's
+// permissions to the request context. It writes the error response itself
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, plaintext string) (*http.Request, bool) {
+	v := validator.New()
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.authenticationFailed(w, r)
+		return r, false
+	}
+	key, user, err := app.models.APIKeys.GetForKey(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.authenticationFailed(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return r, false
+	}
+	// Check the key may be used from this address
+	if !key.AllowsIP(app.clientIP(r)) {
+		app.authenticationFailed(w, r)
+		return r, false
+	}
+	if user.Suspended {
+		app.accountSuspendedResponse(w, r, nil)
+		return r, false
+	}
+	// The key never grants more than its owner currently holds
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return r, false
+	}
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > time.Minute {
+		app.background(func() {
+			err := app.models.APIKeys.Touch(key.ID)
+			if err != nil {
+				app.requestLogger(r).PrintError(err, nil)
+			}
+		})
+	}
+	r = app.contextSetUser(r, user)
+	r = app.contextSetPermissions(r, key.Permissions.Intersect(permissions))
+	r = app.contextSetRestricted(r)
+	return r, true
+}
+
 // Check for activated user
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -160,12 +308,26 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// requireUnrestrictedUser() keeps scope-restricted credentials, API keys and
+// tokens issued to OAuth clients, from minting new credentials that would
+// outlive them or escape their restrictions
+func (app *application) requireUnrestrictedUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextRestricted(r) {
+			app.restrictedCredentialResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return app.requireActivatedUser(fn)
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// get the user
 		user := app.contextGetUser(r)
 		// get the permission slice for the user
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.permissionsFor(r, user)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -182,20 +344,56 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	return app.requireActivatedUser(fn)
 }
 
+// requireForumPermission() is requirePermission() for routes with a forum :id.
+// A grant scoped to that forum is enough, but only for unrestricted sessions,
+// API keys and OAuth tokens are held to the codes they carry
+func (app *application) requireForumPermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forumID, err := app.readIDParam(r)
+		if err != nil {
+			app.notFoundReponse(w, r)
+			return
+		}
+		permitted, err := app.hasForumPermission(r, forumID, code)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !permitted {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireActivatedUser(fn)
+}
+
 // Enable CORS
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		//Add Vary:Origin headers
+		//Add Vary headers, the answer depends on all of these
 		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
 		//Get the value of the request's origin header
 		origin := r.Header.Get("Origin")
-		//Check if origin header present
-		if origin != "" {
-			for i := range app.config.cors.trustedOrigins {
-				if origin == app.config.cors.trustedOrigins[i] {
-					w.Header().Set("Access-Control-Allow-Origin", origin)
-					break
-				}
+		//Check if origin header present and trusted
+		if origin != "" && app.trustedOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			//Let trusted frontends send their credentials
+			if app.config.cors.credentials || app.config.session.enabled {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			//A preflight asks before the real request is sent, answer it
+			//here without authenticating or rate limiting it
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(app.config.cors.maxAge.Seconds())))
+				w.WriteHeader(http.StatusOK)
+				return
 			}
 		}
 
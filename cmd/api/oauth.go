@@ -0,0 +1,371 @@
+// Filename: cmd/api/oauth.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"forum.kevin.net/internal/data"
+	"forum.kevin.net/internal/jwt"
+	"forum.kevin.net/internal/validator"
+)
+
+// How long an authorization code can wait to be exchanged
+const authorizationCodeTTL = 10 * time.Minute
+
+// The parameters of an authorization request (RFC 6749 section 4.1.1 with
+// the PKCE additions from RFC 7636)
+type authorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// Register a third-party client
+func (app *application) registerOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	user := app.contextGetUser(r)
+	client := &data.OAuthClient{
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Confidential: input.Confidential,
+		OwnerID:      user.ID,
+	}
+	v := validator.New()
+	if data.ValidateOAuthClient(v, client); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.OAuthClients.Insert(client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// The client secret is only ever shown here
+	err = app.writeJSON(w, http.StatusCreated, envelope{"client": client}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// List the clients the current user registered
+func (app *application) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	clients, err := app.models.OAuthClients.GetAllForOwner(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"clients": clients}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Show the consent details of an authorization request
+func (app *application) showAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	req := authorizationRequest{
+		ResponseType:        app.readString(qs, "response_type", ""),
+		ClientID:            app.readString(qs, "client_id", ""),
+		RedirectURI:         app.readString(qs, "redirect_uri", ""),
+		Scope:               app.readString(qs, "scope", ""),
+		State:               app.readString(qs, "state", ""),
+		CodeChallenge:       app.readString(qs, "code_challenge", ""),
+		CodeChallengeMethod: app.readString(qs, "code_challenge_method", ""),
+	}
+	client, scopes, ok := app.checkAuthorizationRequest(w, r, req)
+	if !ok {
+		return
+	}
+	env := envelope{
+		"authorization": map[string]interface{}{
+			"client": map[string]string{
+				"client_id": client.ClientID,
+				"name":      client.Name,
+			},
+			"scopes":       scopes,
+			"redirect_uri": req.RedirectURI,
+			"state":        req.State,
+		},
+	}
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Record the user's consent decision and return where to send the browser
+func (app *application) approveAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		authorizationRequest
+		Approved bool `json:"approved"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	client, scopes, ok := app.checkAuthorizationRequest(w, r, input.authorizationRequest)
+	if !ok {
+		return
+	}
+	params := url.Values{}
+	if input.State != "" {
+		params.Set("state", input.State)
+	}
+	if !input.Approved {
+		params.Set("error", "access_denied")
+	} else {
+		code := &data.AuthorizationCode{
+			ClientID:      client.ID,
+			UserID:        app.contextGetUser(r).ID,
+			RedirectURI:   input.RedirectURI,
+			Scopes:        scopes,
+			CodeChallenge: input.CodeChallenge,
+		}
+		err = app.models.OAuthCodes.New(code, authorizationCodeTTL)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		params.Set("code", code.Plaintext)
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"redirect_to": addQuery(input.RedirectURI, params)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkAuthorizationRequest() validates an authorization request for the
+// current user. It writes the error response itself
+func (app *application) checkAuthorizationRequest(w http.ResponseWriter, r *http.Request, req authorizationRequest) (*data.OAuthClient, data.Permissions, bool) {
+	// Only the user themselves may consent, not another client, an API key or a
+	// service account
+	token := app.contextGetToken(r)
+	if token == nil || token.ClientID != nil || app.contextGetUser(r).ServiceAccount {
+		app.notPermittedResponse(w, r)
+		return nil, nil, false
+	}
+	v := validator.New()
+	v.Check(req.ResponseType == "code", "response_type", "must be code")
+	v.Check(req.ClientID != "", "client_id", "must be provided")
+	v.Check(len(req.State) <= 500, "state", "must not be more than 500 bytes long")
+	data.ValidateCodeChallenge(v, req.CodeChallenge, req.CodeChallengeMethod)
+	scopes := data.Permissions(strings.Fields(req.Scope))
+	v.Check(len(scopes) > 0, "scope", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, nil, false
+	}
+	client, err := app.models.OAuthClients.GetByClientID(req.ClientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("client_id", "unknown client")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, nil, false
+	}
+	// Never send the browser anywhere that was not registered
+	if !client.AllowsRedirect(req.RedirectURI) {
+		v.AddError("redirect_uri", "must match a registered redirect URI")
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, nil, false
+	}
+	// A user can only delegate permissions they hold
+	permissions, err := app.permissionsFor(r, app.contextGetUser(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, nil, false
+	}
+	if !permissions.IncludeAll(scopes...) {
+		v.AddError("scope", "must only contain permissions you hold")
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, nil, false
+	}
+	return client, scopes, true
+}
+
+// Exchange an authorization code or refresh token for tokens
+func (app *application) oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := app.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+	var access, refresh *data.Token
+	var err error
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		access, refresh, ok = app.exchangeAuthorizationCode(w, r, client)
+		if !ok {
+			return
+		}
+	case "refresh_token":
+		access, refresh, err = app.models.Tokens.Rotate(r.PostForm.Get("refresh_token"), &client.ID, app.config.tokens.accessTTL, app.config.tokens.refreshTTL, r.UserAgent(), app.clientIP(r))
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrTokenReused):
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid, expired or reused refresh token")
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	default:
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or refresh_token")
+		return
+	}
+	err = app.signAccessToken(access)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// The field names are fixed by RFC 6749 section 5.1
+	env := envelope{
+		"access_token":  access.Plaintext,
+		"token_type":    "Bearer",
+		"expires_in":    int(time.Until(access.Expiry).Seconds()),
+		"refresh_token": refresh.Plaintext,
+		"scope":         strings.Join(access.Permissions, " "),
+	}
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+	headers.Set("Pragma", "no-cache")
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// exchangeAuthorizationCode() checks a code, its redirect URI and PKCE
+// verifier and issues a token pair. It writes the error response itself
+func (app *application) exchangeAuthorizationCode(w http.ResponseWriter, r *http.Request, client *data.OAuthClient) (*data.Token, *data.Token, bool) {
+	v := validator.New()
+	if data.ValidateCodeVerifier(v, r.PostForm.Get("code_verifier")); !v.Valid() {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", v.Errors["code_verifier"])
+		return nil, nil, false
+	}
+	code, err := app.models.OAuthCodes.Consume(r.PostForm.Get("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, nil, false
+	}
+	// The code is gone now, so every mismatch below burns it
+	if code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") || !code.VerifierMatches(r.PostForm.Get("code_verifier")) {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+		return nil, nil, false
+	}
+	access, refresh, err := app.models.Tokens.NewOAuthSessionPair(code.UserID, client.ID, code.Scopes, app.config.tokens.accessTTL, app.config.tokens.refreshTTL, r.UserAgent(), app.clientIP(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, nil, false
+	}
+	return access, refresh, true
+}
+
+// Revoke a token issued to the calling client (RFC 7009)
+func (app *application) oauthRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := app.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+	token := r.PostForm.Get("token")
+	// Signed access tokens are revoked through the denylist
+	if app.config.tokens.mode == "signed" && jwt.Looks(token) {
+		claims, err := app.signingKeys.Verify(token, time.Now())
+		if err == nil && claims.ClientID == client.ID {
+			sessionID, _ := strconv.ParseInt(claims.ID, 10, 64)
+			err = app.denySessions(sessionID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			err = app.models.Tokens.DeleteSessionForUser(claims.Subject, sessionID)
+			if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	} else {
+		err := app.models.Tokens.DeleteFamilyForClient(token, client.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	// Unknown tokens are not an error (RFC 7009 section 2.2)
+	err := app.writeJSON(w, http.StatusOK, envelope{}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// authenticateOAuthClient() parses the form body and checks the client
+// credentials from HTTP Basic auth or the form. It writes the error response itself
+func (app *application) authenticateOAuthClient(w http.ResponseWriter, r *http.Request) (*data.OAuthClient, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+		return nil, false
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	client, err := app.models.OAuthClients.GetByClientID(clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidOAuthClientResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	if !client.SecretMatches(secret) {
+		app.invalidOAuthClientResponse(w, r)
+		return nil, false
+	}
+	return client, true
+}
+
+// addQuery() appends parameters to a redirect URI that may already have a query
+func addQuery(redirectURI string, params url.Values) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	qs := u.Query()
+	for key := range params {
+		qs.Set(key, params.Get(key))
+	}
+	u.RawQuery = qs.Encode()
+	return u.String()
+}
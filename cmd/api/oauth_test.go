@@ -0,0 +1,378 @@
+// Filename: cmd/api/oauth_test.go
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"forum.kevin.net/internal/data"
+	"forum.kevin.net/internal/jsonlog"
+	"forum.kevin.net/internal/jwt"
+	"forum.kevin.net/internal/realip"
+)
+
+// The OAuth tests run the whole flow against a migrated database, so they
+// are skipped unless one is given
+const testDBEnv = "TESTFORUM_TEST_DB_DSN"
+
+// oauthTestServer holds a running API and a signed in user's bearer token
+type oauthTestServer struct {
+	*httptest.Server
+	token string
+}
+
+// newOAuthTestServer() starts the API on the test database with a fresh
+// activated member, who is deleted along with everything they own after the test
+func newOAuthTestServer(t *testing.T) *oauthTestServer {
+	t.Helper()
+	dsn := os.Getenv(testDBEnv)
+	if dsn == "" {
+		t.Skipf("%s not set", testDBEnv)
+	}
+	var cfg config
+	cfg.db.dsn = dsn
+	cfg.db.maxOpenConns = 5
+	cfg.db.maxIdleConns = 5
+	cfg.db.MaxIdleTime = "1m"
+	cfg.tokens.mode = "database"
+	cfg.tokens.accessTTL = 15 * time.Minute
+	cfg.tokens.refreshTTL = time.Hour
+	cfg.limiter.store = "memory"
+	cfg.limiter.ipRPS, cfg.limiter.ipBurst = 100, 100
+	cfg.limiter.rps, cfg.limiter.burst = 100, 100
+	cfg.limiter.authRPS, cfg.limiter.authBurst = 100, 100
+
+	db, err := openDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	limiter, err := newRateLimiter(cfg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipResolver, err := realip.New(nil, "X-Forwarded-For")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKeys, err := jwt.ParseKeySet("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{
+		config:      cfg,
+		logger:      jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models:      data.NewModels(db, nil),
+		signingKeys: signingKeys,
+		denylist:    newDenylist(),
+		limiter:     limiter,
+		ipResolver:  ipResolver,
+	}
+
+	// A unique address keeps runs from colliding
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		t.Fatal(err)
+	}
+	user := &data.User{
+		Name:      "OAuth Test",
+		Email:     "oauth-" + hex.EncodeToString(suffix) + "@example.com",
+		Activated: true,
+	}
+	if err := user.Password.Set("pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Users.Insert(user); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM users WHERE id = $1`, user.ID) })
+	if err := app.models.Roles.AddForUser(user.ID, "member"); err != nil {
+		t.Fatal(err)
+	}
+	access, _, err := app.models.Tokens.NewSessionPair(user.ID, "", cfg.tokens.accessTTL, cfg.tokens.refreshTTL, "oauth-test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(app.routes())
+	t.Cleanup(ts.Close)
+	return &oauthTestServer{Server: ts, token: access.Plaintext}
+}
+
+// do() sends a request and decodes the JSON response into dst
+func (ts *oauthTestServer) do(t *testing.T, req *http.Request, dst interface{}) int {
+	t.Helper()
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if dst != nil {
+		if err := json.NewDecoder(res.Body).Decode(dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode
+}
+
+// postJSON() sends a JSON body as the signed in user
+func (ts *oauthTestServer) postJSON(t *testing.T, path string, body interface{}, dst interface{}) int {
+	t.Helper()
+	js, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, ts.URL+path, bytes.NewReader(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+ts.token)
+	return ts.do(t, req, dst)
+}
+
+// postForm() sends a form body authenticated as an OAuth client
+func (ts *oauthTestServer) postForm(t *testing.T, path string, client testOAuthClient, form url.Values, dst interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ClientID, client.Secret)
+	return ts.do(t, req, dst)
+}
+
+// The parts of a registered client the tests need
+type testOAuthClient struct {
+	ClientID     string   `json:"client_id"`
+	Secret       string   `json:"client_secret"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// Token endpoint responses, successful or not
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	Error        string `json:"error"`
+}
+
+const testRedirectURI = "http://127.0.0.1:8080/callback"
+
+// registerClient() registers a confidential client for the test user
+func (ts *oauthTestServer) registerClient(t *testing.T) testOAuthClient {
+	t.Helper()
+	var res struct {
+		Client testOAuthClient `json:"client"`
+	}
+	status := ts.postJSON(t, "/v1/oauth/clients", map[string]interface{}{
+		"name":          "Test client",
+		"redirect_uris": []string{testRedirectURI},
+		"confidential":  true,
+	}, &res)
+	if status != http.StatusCreated {
+		t.Fatalf("register client: got status %d", status)
+	}
+	if res.Client.ClientID == "" || res.Client.Secret == "" {
+		t.Fatalf("register client: missing client_id or client_secret in %+v", res.Client)
+	}
+	return res.Client
+}
+
+// newVerifier() returns a PKCE code verifier and its S256 challenge
+func newVerifier(t *testing.T) (string, string) {
+	t.Helper()
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	verifier := base64.RawURLEncoding.EncodeToString(b)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorize() goes through consent and returns the authorization code
+func (ts *oauthTestServer) authorize(t *testing.T, client testOAuthClient, challenge string) string {
+	t.Helper()
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ClientID},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {"forum:read"},
+		"state":                 {"xyz"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	// The consent screen is shown first
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/oauth/authorize?"+params.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+ts.token)
+	var consent struct {
+		Authorization struct {
+			Client struct {
+				ClientID string `json:"client_id"`
+			} `json:"client"`
+			Scopes []string `json:"scopes"`
+		} `json:"authorization"`
+	}
+	if status := ts.do(t, req, &consent); status != http.StatusOK {
+		t.Fatalf("show authorization: got status %d", status)
+	}
+	if consent.Authorization.Client.ClientID != client.ClientID {
+		t.Fatalf("show authorization: got client %q, want %q", consent.Authorization.Client.ClientID, client.ClientID)
+	}
+
+	// Then approved
+	body := map[string]interface{}{"approved": true}
+	for key := range params {
+		body[key] = params.Get(key)
+	}
+	var res struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+	if status := ts.postJSON(t, "/v1/oauth/authorize", body, &res); status != http.StatusOK {
+		t.Fatalf("approve authorization: got status %d", status)
+	}
+	redirect, err := url.Parse(res.RedirectTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redirect.Query().Get("state") != "xyz" {
+		t.Fatalf("approve authorization: state not returned in %q", res.RedirectTo)
+	}
+	code := redirect.Query().Get("code")
+	if code == "" {
+		t.Fatalf("approve authorization: no code in %q", res.RedirectTo)
+	}
+	return code
+}
+
+// exchange() trades a code for tokens
+func (ts *oauthTestServer) exchange(t *testing.T, client testOAuthClient, code, verifier string) (int, tokenResponse) {
+	t.Helper()
+	var res tokenResponse
+	status := ts.postForm(t, "/v1/oauth/token", client, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	}, &res)
+	return status, res
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	ts := newOAuthTestServer(t)
+	client := ts.registerClient(t)
+	verifier, challenge := newVerifier(t)
+	code := ts.authorize(t, client, challenge)
+
+	status, tokens := ts.exchange(t, client, code, verifier)
+	if status != http.StatusOK {
+		t.Fatalf("exchange: got status %d (%s)", status, tokens.Error)
+	}
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatal("exchange: missing access or refresh token")
+	}
+	if tokens.Scope != "forum:read" {
+		t.Fatalf("exchange: got scope %q, want %q", tokens.Scope, "forum:read")
+	}
+
+	// A code can only be used once
+	status, tokens = ts.exchange(t, client, code, verifier)
+	if status != http.StatusBadRequest || tokens.Error != "invalid_grant" {
+		t.Fatalf("reused code: got status %d error %q, want 400 invalid_grant", status, tokens.Error)
+	}
+}
+
+func TestOAuthInvalidCodeVerifier(t *testing.T) {
+	ts := newOAuthTestServer(t)
+	client := ts.registerClient(t)
+	verifier, challenge := newVerifier(t)
+	code := ts.authorize(t, client, challenge)
+
+	wrong, _ := newVerifier(t)
+	status, tokens := ts.exchange(t, client, code, wrong)
+	if status != http.StatusBadRequest || tokens.Error != "invalid_grant" {
+		t.Fatalf("wrong verifier: got status %d error %q, want 400 invalid_grant", status, tokens.Error)
+	}
+	// The failed attempt burns the code, even for the right verifier
+	status, tokens = ts.exchange(t, client, code, verifier)
+	if status != http.StatusBadRequest || tokens.Error != "invalid_grant" {
+		t.Fatalf("code after failed exchange: got status %d error %q, want 400 invalid_grant", status, tokens.Error)
+	}
+}
+
+func TestOAuthRevoke(t *testing.T) {
+	ts := newOAuthTestServer(t)
+	client := ts.registerClient(t)
+	verifier, challenge := newVerifier(t)
+	code := ts.authorize(t, client, challenge)
+	status, tokens := ts.exchange(t, client, code, verifier)
+	if status != http.StatusOK {
+		t.Fatalf("exchange: got status %d (%s)", status, tokens.Error)
+	}
+
+	// The access token works until the session is revoked
+	get := func() int {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/oauth/clients", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		return ts.do(t, req, nil)
+	}
+	if status := get(); status != http.StatusOK {
+		t.Fatalf("before revoke: got status %d", status)
+	}
+	if status := ts.postForm(t, "/v1/oauth/revoke", client, url.Values{"token": {tokens.RefreshToken}}, nil); status != http.StatusOK {
+		t.Fatalf("revoke: got status %d", status)
+	}
+	if status := get(); status != http.StatusUnauthorized {
+		t.Fatalf("access token after revoke: got status %d, want 401", status)
+	}
+	var res tokenResponse
+	status = ts.postForm(t, "/v1/oauth/token", client, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {tokens.RefreshToken},
+	}, &res)
+	if status != http.StatusBadRequest || res.Error != "invalid_grant" {
+		t.Fatalf("refresh after revoke: got status %d error %q, want 400 invalid_grant", status, res.Error)
+	}
+
+	// Unknown tokens are accepted silently
+	if status := ts.postForm(t, "/v1/oauth/revoke", client, url.Values{"token": {"unknown"}}, nil); status != http.StatusOK {
+		t.Fatalf("revoke unknown token: got status %d", status)
+	}
+}
+
+// Client credentials in Basic auth reach the token endpoints, the
+// authentication middleware leaves them to the handler
+func TestBasicAuthPassesAuthentication(t *testing.T) {
+	app := &application{logger: jsonlog.New(io.Discard, jsonlog.LevelOff)}
+	var anonymous bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		anonymous = app.contextGetUser(r).IsAnonymous()
+	})
+	req := httptest.NewRequest(http.MethodPost, "/v1/oauth/token", nil)
+	req.SetBasicAuth("client", "secret")
+	rr := httptest.NewRecorder()
+	app.authentication(next).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !anonymous {
+		t.Fatalf("got status %d, anonymous %v, want 200 and an anonymous user", rr.Code, anonymous)
+	}
+}
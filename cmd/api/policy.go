@@ -0,0 +1,95 @@
+// Filename: cmd/api/policy.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"forum.kevin.net/internal/data"
+	"forum.kevin.net/internal/policy"
+	"forum.kevin.net/internal/validator"
+)
+
+// newContentPolicy() builds the content policy from the configuration
+func newContentPolicy(cfg config) (*policy.Policy, error) {
+	var rules []policy.Rule
+	// Each rule is only added when it was configured
+	add := func(checker policy.Checker, action string) error {
+		a, ok := policy.ParseAction(action)
+		if !ok {
+			return fmt.Errorf("invalid %s policy action %q", checker.Name(), action)
+		}
+		rules = append(rules, policy.Rule{Checker: checker, Action: a})
+		return nil
+	}
+	if cfg.policy.wordsFile != "" {
+		words, err := policy.LoadWordList(cfg.policy.wordsFile)
+		if err != nil {
+			return nil, err
+		}
+		err = add(words, cfg.policy.wordsAction)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.policy.maxLinks >= 0 {
+		err := add(policy.LinkCount{Max: cfg.policy.maxLinks}, cfg.policy.linksAction)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.policy.blockedDomains) > 0 {
+		err := add(policy.NewDomainBlocklist(cfg.policy.blockedDomains), cfg.policy.domainsAction)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return policy.New(rules...), nil
+}
+
+// forumPolicyFields() returns the text of a forum the policy looks at
+func forumPolicyFields(forum *data.Forum) map[string]string {
+	return map[string]string{
+		"title":       forum.Title,
+		"category":    forum.Category,
+		"description": forum.Description,
+		"publisher":   forum.Publisher,
+	}
+}
+
+// checkContentPolicy() evaluates submitted text and adds a validation error
+// for each rule that rejects it
+func (app *application) checkContentPolicy(v *validator.Validator, fields map[string]string) policy.Result {
+	result := app.contentPolicy.Evaluate(fields)
+	for _, violation := range result.Violations {
+		if violation.Action == policy.Reject {
+			v.AddError(violation.Field, violation.Reason)
+		}
+	}
+	return result
+}
+
+// queueForPolicy() sends a stored forum that was held or flagged to the
+// moderation queue. Held forums are hidden until a moderator releases them.
+// The forum is already saved, so like app.audit() a failure is only logged
+// rather than failing a request that has taken effect
+func (app *application) queueForPolicy(r *http.Request, forum *data.Forum, result policy.Result) {
+	if result.Action != policy.Hold && result.Action != policy.Flag {
+		return
+	}
+	reasons := make([]string, len(result.Violations))
+	for i, violation := range result.Violations {
+		reasons[i] = violation.Field + ": " + violation.Reason
+	}
+	err := app.models.Reports.InsertForPolicy(forum, strings.Join(reasons, "; "), result.Action == policy.Hold)
+	if err != nil {
+		app.requestLogger(r).PrintError(err, map[string]string{
+			"policy_action": result.Action.String(),
+			"forum_id":      strconv.FormatInt(forum.ID, 10),
+		})
+		return
+	}
+	app.audit(r, "policy."+result.Action.String(), "forum", forum.ID, nil, envelope{"violations": result.Violations})
+}
@@ -0,0 +1,96 @@
+// Filename: cmd/api/ratelimit.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"forum.kevin.net/internal/ratelimit"
+)
+
+// The rate limiter applies named policies, each a limit per client, on top
+// of a store that remembers how much of it every client used
+type rateLimiter struct {
+	store    ratelimit.Store
+	policies map[string]ratelimit.Limit
+}
+
+// newRateLimiter() builds the limiter from the configuration
+func newRateLimiter(cfg config, db *sql.DB) (*rateLimiter, error) {
+	l := &rateLimiter{
+		policies: map[string]ratelimit.Limit{
+			"ip":      {Rate: cfg.limiter.ipRPS, Burst: cfg.limiter.ipBurst},
+			"default": {Rate: cfg.limiter.rps, Burst: cfg.limiter.burst},
+			"auth":    {Rate: cfg.limiter.authRPS, Burst: cfg.limiter.authBurst},
+		},
+	}
+	for name, limit := range l.policies {
+		if limit.Rate <= 0 || limit.Burst < 1 {
+			return nil, fmt.Errorf("%s rate limit must have a positive rate and burst", name)
+		}
+	}
+	switch cfg.limiter.store {
+	case "memory":
+		l.store = ratelimit.NewMemoryStore()
+	case "postgres":
+		l.store = ratelimit.PostgresStore{DB: db}
+	default:
+		return nil, fmt.Errorf("invalid rate limiter store %q", cfg.limiter.store)
+	}
+	return l, nil
+}
+
+// rateLimitKey() identifies the client a limit applies to. Signed in users
+// are limited however many addresses they use, everyone else by address
+func (app *application) rateLimitKey(r *http.Request) string {
+	user := app.contextGetUser(r)
+	if !user.IsAnonymous() {
+		return "user:" + strconv.FormatInt(user.ID, 10)
+	}
+	return "ip:" + app.clientIP(r)
+}
+
+// checkRateLimit() counts the request against a policy and reports whether
+// it may go ahead. When it may not the response has already been sent
+func (app *application) checkRateLimit(w http.ResponseWriter, r *http.Request, policy, key string) bool {
+	if !app.config.limiter.enabled {
+		return true
+	}
+	limit := app.limiter.policies[policy]
+	result, err := app.limiter.store.Allow(r.Context(), policy+":"+key, limit)
+	if err != nil {
+		// A broken store should not take the whole API down with it
+		app.requestLogger(r).PrintError(err, map[string]string{"policy": policy})
+		return true
+	}
+	setRateLimitHeaders(w, result)
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+		app.rateLimitExceededResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// setRateLimitHeaders() describes a limit with the RateLimit-* headers. When
+// several policies apply the headers show the one closest to running out
+func setRateLimitHeaders(w http.ResponseWriter, result ratelimit.Result) {
+	if current := w.Header().Get("RateLimit-Remaining"); current != "" {
+		remaining, err := strconv.Atoi(current)
+		if err == nil && remaining < result.Remaining {
+			return
+		}
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+}
+
+// ceilSeconds() rounds a duration up to whole seconds for headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,240 @@
+// Filename: cmd/api/reports.go
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"forum.kevin.net/internal/data"
+	"forum.kevin.net/internal/validator"
+)
+
+// Report a forum to the moderators
+func (app *application) createReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundReponse(w, r)
+		return
+	}
+	var input struct {
+		Reason string `json:"reason"`
+		Note   string `json:"note"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Hidden forums are already out of sight
+	forum, err := app.models.Forums.Get(id)
+	if err == nil && forum.Hidden {
+		err = data.ErrRecordNotFound
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundReponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	user := app.contextGetUser(r)
+	report := &data.Report{
+		ForumID:    forum.ID,
+		ReporterID: &user.ID,
+		Reason:     input.Reason,
+		Note:       input.Note,
+	}
+	v := validator.New()
+	if data.ValidateReport(v, report); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	created, err := app.models.Reports.Insert(report)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Reporting the same forum again only updates the open report
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		app.audit(r, "report.create", "forum", forum.ID, nil, report)
+	}
+	err = app.writeJSON(w, status, envelope{"report": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// List reported forums with their open reports, most reported first
+func (app *application) listReportsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-report_count")
+	input.Filters.SortList = []string{"report_count", "first_reported_at", "-report_count", "-first_reported_at"}
+
+	if data.ValidateFilter(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	groups, metadata, err := app.models.Reports.GetOpenGroups(input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"reports": groups, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Resolve the open reports on a forum by dismissing them, hiding the forum or
+// deleting it, optionally warning its author and telling the reporters
+func (app *application) moderateForumHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundReponse(w, r)
+		return
+	}
+	var input struct {
+		Action          string `json:"action"`
+		Note            string `json:"note"`
+		Warning         string `json:"warning"`
+		NotifyReporters bool   `json:"notify_reporters"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Each action closes the reports with its own status
+	statuses := map[string]string{
+		"dismiss": data.ReportDismissed,
+		"hide":    data.ReportHidden,
+		"delete":  data.ReportDeleted,
+	}
+	v := validator.New()
+	status, ok := statuses[input.Action]
+	v.Check(ok, "action", "must be dismiss, hide or delete")
+	v.Check(len(input.Note) <= 1000, "note", "must not be more than 1000 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	forum, err := app.models.Forums.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundReponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	moderator := app.contextGetUser(r)
+	var warning *data.Warning
+	if input.Warning != "" {
+		if forum.UserID == nil {
+			v.AddError("warning", "the author of this forum no longer exists")
+		} else {
+			warning = &data.Warning{
+				UserID:      *forum.UserID,
+				ModeratorID: &moderator.ID,
+				ForumID:     &forum.ID,
+				Message:     input.Warning,
+			}
+			data.ValidateWarning(v, warning)
+		}
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	reporters, err := app.models.Reports.Resolve(forum.ID, moderator.ID, status, input.Note, warning)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundReponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	var after *data.Forum
+	switch status {
+	case data.ReportHidden:
+		hidden := *forum
+		hidden.Hidden = true
+		after = &hidden
+	case data.ReportDismissed:
+		released := *forum
+		released.Hidden = false
+		after = &released
+	}
+	app.audit(r, "moderation."+input.Action, "forum", forum.ID, forum, after)
+
+	if warning != nil {
+		app.audit(r, "moderation.warn", "user", warning.UserID, nil, warning)
+		app.sendWarning(r, warning, forum)
+	}
+	if input.NotifyReporters {
+		for _, reporter := range reporters {
+			reporter := reporter
+			app.background(func() {
+				data := map[string]interface{}{
+					"name":       reporter.Name,
+					"forumTitle": forum.Title,
+					"outcome":    status,
+				}
+				err := app.sendMail(reporter.Email, "report_resolved.tmpl", data)
+				if err != nil {
+					app.requestLogger(r).PrintError(err, nil)
+				}
+			})
+		}
+	}
+
+	env := envelope{
+		"resolution": map[string]interface{}{
+			"forum_id":         forum.ID,
+			"status":           status,
+			"reports_resolved": len(reporters),
+		},
+	}
+	if warning != nil {
+		env["warning"] = warning
+	}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// sendWarning() emails a warning to the author of a forum
+func (app *application) sendWarning(r *http.Request, warning *data.Warning, forum *data.Forum) {
+	app.background(func() {
+		author, err := app.models.Users.Get(warning.UserID)
+		if err != nil {
+			app.requestLogger(r).PrintError(err, nil)
+			return
+		}
+		data := map[string]interface{}{
+			"name":       author.Name,
+			"forumTitle": forum.Title,
+			"message":    warning.Message,
+		}
+		err = app.sendMail(author.Email, "user_warning.tmpl", data)
+		if err != nil {
+			app.requestLogger(r).PrintError(err, nil)
+		}
+	})
+}
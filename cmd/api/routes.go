@@ -3,12 +3,10 @@ package main
 
 import (
 	"net/http"
-
-	"github.com/julienschmidt/httprouter"
 )
 
 func (app *application) routes() http.Handler {
-	router := httprouter.New()
+	router := newRouteRecorder()
 
 	//security routes
 	router.NotFound = http.HandlerFunc(app.notFoundReponse)
@@ -16,13 +14,46 @@ func (app *application) routes() http.Handler {
 
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 	router.HandlerFunc(http.MethodGet, "/v1/forum", app.requirePermission("forum:read", app.listForumHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/forum", app.requirePermission("forum:write", app.createForumHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/forum", app.requirePermission("forum:write", app.idempotent(app.createForumHandler)))
 	router.HandlerFunc(http.MethodGet, "/v1/forum/:id", app.requirePermission("forum:read", app.showForumHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/forum/:id", app.requirePermission("forum:write", app.updateForumHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/forum/:id", app.requirePermission("forum:write", app.deleteForumHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/forum/:id", app.requireForumPermission("forum:write", app.updateForumHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/forum/:id", app.requireForumPermission("forum:write", app.deleteForumHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/forum/:id/reports", app.requireActivatedUser(app.idempotent(app.createReportHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/moderation/reports", app.requirePermission("forum:moderate", app.listReportsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/moderation/forums/:id", app.requireForumPermission("forum:moderate", app.idempotent(app.moderateForumHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/moderation/suspensions", app.requirePermission("forum:moderate", app.listSuspensionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/moderation/suspensions", app.requirePermission("forum:moderate", app.idempotent(app.createSuspensionHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/moderation/suspensions/:id", app.requirePermission("forum:moderate", app.liftSuspensionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users", app.limitRoute("auth", app.registerUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.limitRoute("auth", app.activateUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/audit-events", app.requirePermission("admin:read", app.listAuditEventsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions", app.requirePermission("admin:read", app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("admin:read", app.searchUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/permissions", app.requirePermission("admin:read", app.showUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("admin:write", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions", app.requirePermission("admin:write", app.revokeUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", app.requirePermission("admin:write", app.assignUserRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles", app.requirePermission("admin:write", app.removeUserRoleHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requirePermission("forum:write", app.enrollTOTPHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/totp/confirmed", app.requirePermission("forum:write", app.confirmTOTPHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireAuthenticatedUser(app.deleteSessionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/service-accounts", app.requireUnrestrictedUser(app.idempotent(app.createServiceAccountHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/service-accounts", app.requireActivatedUser(app.listServiceAccountsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/api-keys", app.requireUnrestrictedUser(app.createAPIKeyHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/api-keys", app.requireActivatedUser(app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/api-keys/:id", app.requireActivatedUser(app.deleteAPIKeyHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/clients", app.requireActivatedUser(app.registerOAuthClientHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/clients", app.requireActivatedUser(app.listOAuthClientsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/authorize", app.requireActivatedUser(app.showAuthorizationHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/authorize", app.requireActivatedUser(app.approveAuthorizationHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/token", app.limitRoute("auth", app.oauthTokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/revoke", app.oauthRevokeHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.limitRoute("auth", app.createAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireAuthenticatedUser(app.deleteAllAuthenticationTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.limitRoute("auth", app.refreshAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/totp", app.limitRoute("auth", app.createTOTPAuthenticationTokenHandler))
 
-	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authentication(router))))
+	return app.assignRequestID(app.realIP(app.observeRequests(router.matchRoute(app.negotiateResponse(app.recoverPanic(app.enableCORS(app.authentication(app.rateLimit(router)))))))))
 }
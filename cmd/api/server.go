@@ -23,6 +23,29 @@ func (app *application) serve() error {
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
+	// The metrics get a server of their own, usually only reachable locally
+	var metricsSrv *http.Server
+	if app.config.metricsAddr != "" && app.metrics != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", app.metrics.registry.Handler())
+		metricsSrv = &http.Server{
+			Addr:         app.config.metricsAddr,
+			Handler:      mux,
+			ErrorLog:     log.New(app.logger, "", 0),
+			IdleTimeout:  time.Minute,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		go func() {
+			app.logger.PrintInfo("starting metrics server", map[string]string{
+				"addr": metricsSrv.Addr,
+			})
+			err := metricsSrv.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintError(err, map[string]string{"addr": metricsSrv.Addr})
+			}
+		}()
+	}
 	// The Shutdown() function should return its error to this channel
 	shutdownError := make(chan error)
 
@@ -42,7 +65,14 @@ func (app *application) serve() error {
 		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 		defer cancel()
 		// Call the Shutdown() function
-		shutdownError <- srv.Shutdown(ctx)
+		err := srv.Shutdown(ctx)
+		// Keep the metrics up until the API has drained
+		if metricsSrv != nil {
+			metricsSrv.Shutdown(ctx)
+		}
+		// Let the maintenance worker finish its current batch
+		app.stopMaintenance()
+		shutdownError <- err
 	}()
 
 	// Start our server
@@ -0,0 +1,151 @@
+// Filename: cmd/api/suspensions.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"forum.kevin.net/internal/data"
+	"forum.kevin.net/internal/validator"
+)
+
+// Suspend a user, ending every session they have
+func (app *application) createSuspensionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID int64      `json:"user_id"`
+		Reason string     `json:"reason"`
+		Expiry *time.Time `json:"expiry"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	moderator := app.contextGetUser(r)
+	suspension := &data.Suspension{
+		UserID:      input.UserID,
+		ModeratorID: &moderator.ID,
+		Reason:      input.Reason,
+		Expiry:      input.Expiry,
+	}
+	v := validator.New()
+	data.ValidateSuspension(v, suspension)
+	v.Check(suspension.UserID != moderator.ID, "user_id", "must not be yourself")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	_, err = app.models.Users.Get(suspension.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("user_id", "must be an existing user")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Only admins may suspend other moderators
+	target, err := app.models.Permissions.GetAllForUser(suspension.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if target.Include("forum:moderate") {
+		permissions, err := app.permissionsFor(r, moderator)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !permissions.Include("admin:write") {
+			app.notPermittedResponse(w, r)
+			return
+		}
+	}
+	// Deny the signed tokens of their sessions before the rows are gone
+	err = app.denyUserSessions(suspension.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Suspensions.Insert(suspension)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.audit(r, "user.suspend", "user", suspension.UserID, nil, suspension)
+	err = app.writeJSON(w, http.StatusCreated, envelope{"suspension": suspension}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// List the suspensions in force
+func (app *application) listSuspensionsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = "-id"
+	input.Filters.SortList = []string{"-id"}
+
+	if data.ValidateFilter(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	suspensions, metadata, err := app.models.Suspensions.GetAllActive(input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"suspensions": suspensions, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Lift a suspension before it expires
+func (app *application) liftSuspensionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundReponse(w, r)
+		return
+	}
+	moderator := app.contextGetUser(r)
+	suspension, err := app.models.Suspensions.Lift(id, moderator.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundReponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.audit(r, "user.unsuspend", "user", suspension.UserID, nil, suspension)
+	err = app.writeJSON(w, http.StatusOK, envelope{"suspension": suspension}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkNotSuspended() writes the suspended response and returns false if the
+// user may not sign in right now
+func (app *application) checkNotSuspended(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	suspension, err := app.models.Suspensions.GetActiveForUser(userID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return true
+		}
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	app.accountSuspendedResponse(w, r, suspension.Expiry)
+	return false
+}
@@ -4,17 +4,23 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"forum.kevin.net/internal/data"
+	"forum.kevin.net/internal/jwt"
 	"forum.kevin.net/internal/validator"
 )
 
+// A second factor challenge is deleted after this many wrong codes
+const totpMaxAttempts = 5
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the email and password from the body
 	var input struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Cookie   bool   `json:"cookie"`
 	}
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -25,6 +31,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	v := validator.New()
 	data.ValidateEmail(v, input.Email)
 	data.ValidatePasswordPlaintext(v, input.Password)
+	app.validateCookieRequest(v, input.Cookie)
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
@@ -40,6 +47,11 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		}
 		return
 	}
+	// Service accounts only authenticate with API keys
+	if user.ServiceAccount {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
 	// Check if the password is the same
 	match, err := user.Password.Matches(input.Password)
 	if err != nil {
@@ -51,15 +63,330 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
+	if !app.checkNotSuspended(w, r, user.ID) {
+		return
+	}
+	//Users with a second factor only get a short-lived challenge token
+	enabled, err := app.models.TOTP.EnabledForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if enabled {
+		token, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeTOTPChallenge)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = app.writeJSON(w, http.StatusCreated, envelope{"totp_challenge_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 	//If password is correct
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	app.sendAuthenticationToken(w, r, user, input.Cookie)
+}
+
+// Exchange a challenge token and a TOTP or recovery code for an authentication token
+func (app *application) createTOTPAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+		Cookie         bool   `json:"cookie"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Exactly one of the codes must be provided
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	switch {
+	case input.RecoveryCode != "":
+		v.Check(input.Code == "", "code", "must not be provided with a recovery code")
+	default:
+		data.ValidateTOTPCode(v, input.Code)
+	}
+	app.validateCookieRequest(v, input.Cookie)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Get the user the challenge was issued to
+	user, err := app.models.Users.GetForToken(data.ScopeTOTPChallenge, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if user.ServiceAccount {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+	// Check the second factor
+	ok, err := app.verifySecondFactor(user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		err = app.models.Tokens.CountFailedAttempt(data.ScopeTOTPChallenge, input.TokenPlaintext, totpMaxAttempts)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+	// The challenge can only be used once
+	err = app.models.Tokens.DeleteAllForUsers(data.ScopeTOTPChallenge, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !app.checkNotSuspended(w, r, user.ID) {
+		return
+	}
+	app.sendAuthenticationToken(w, r, user, input.Cookie)
+}
+
+// Create an authentication token for a user who has passed every check
+func (app *application) sendAuthenticationToken(w http.ResponseWriter, r *http.Request, user *data.User, useCookie bool) {
+	access, refresh, err := app.models.Tokens.NewSessionPair(user.ID, "", app.config.tokens.accessTTL, app.config.tokens.refreshTTL, r.UserAgent(), app.clientIP(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.signAccessToken(access)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// The user is not in the context yet, but they are the one logging in
+	app.audit(app.contextSetUser(r, user), "session.create", "user", user.ID, nil, envelope{"session_id": access.ID})
+	//Return the tokens to the client
+	app.writeSessionTokens(w, r, access, refresh, useCookie)
+}
+
+// writeSessionTokens() sends a new token pair in the response body, or as
+// cookies for browser clients in session mode
+func (app *application) writeSessionTokens(w http.ResponseWriter, r *http.Request, access, refresh *data.Token, useCookie bool) {
+	if useCookie {
+		csrfToken, err := app.setSessionCookies(w, access, refresh)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		env := envelope{
+			"session": map[string]interface{}{
+				"expiry":     access.Expiry,
+				"csrf_token": csrfToken,
+			},
+		}
+		err = app.writeJSON(w, http.StatusCreated, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err := app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": access, "refresh_token": refresh}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// validateCookieRequest() rejects cookie sessions when they are switched off
+func (app *application) validateCookieRequest(v *validator.Validator, useCookie bool) {
+	v.Check(!useCookie || app.config.session.enabled, "cookie", "session cookies are not enabled on this server")
+}
+
+// Exchange a refresh token for a new access and refresh token
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	// Browser clients send the refresh cookie and an empty body
+	useCookie := false
+	cookie, err := r.Cookie(refreshCookieName)
+	if app.config.session.enabled && err == nil && r.ContentLength <= 0 {
+		if !app.validCSRF(r) {
+			app.invalidCSRFTokenResponse(w, r)
+			return
+		}
+		input.RefreshToken = cookie.Value
+		useCookie = true
+	} else {
+		err = app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	access, refresh, err := app.models.Tokens.Rotate(input.RefreshToken, nil, app.config.tokens.accessTTL, app.config.tokens.refreshTTL, r.UserAgent(), app.clientIP(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			app.requestLogger(r).PrintInfo("refresh token reused, token family revoked", map[string]string{
+				"ip": app.clientIP(r),
+			})
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
-	//Return the authentication token to the client
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.signAccessToken(access)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeSessionTokens(w, r, access, refresh, useCookie)
+}
+
+// Log out by revoking the token used for this request
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	token := app.contextGetToken(r)
+	if token == nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	err := app.denySessions(token.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Tokens.DeleteSessionForUser(user.ID, token.ID)
+	// A signed token can outlive its rotated session row, the denylist covers it
+	if errors.Is(err, data.ErrRecordNotFound) && app.config.tokens.mode == "signed" {
+		err = nil
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.audit(r, "session.delete", "user", user.ID, envelope{"session_id": token.ID}, nil)
+	app.clearSessionCookies(w)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "authentication token successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Log out everywhere by revoking every authentication token of the user
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	// Deny the signed tokens of every session before the rows are gone
+	var current []int64
+	if token := app.contextGetToken(r); token != nil {
+		current = append(current, token.ID)
+	}
+	err := app.denyUserSessions(user.ID, current...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err := app.models.Tokens.DeleteAllForUsers(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	app.audit(r, "session.delete_all", "user", user.ID, nil, nil)
+	app.clearSessionCookies(w)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all authentication tokens successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// signAccessToken() replaces the plaintext of a new access token with a signed
+// token carrying the user's claims when running in signed mode. The database
+// row stays behind as the session record
+func (app *application) signAccessToken(access *data.Token) error {
+	if app.config.tokens.mode != "signed" {
+		return nil
+	}
+	user, err := app.models.Users.Get(access.UserID)
+	if err != nil {
+		return err
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+	if access.Permissions != nil {
+		permissions = permissions.Intersect(access.Permissions)
+	}
+	claims := jwt.Claims{
+		ID:          strconv.FormatInt(access.ID, 10),
+		Subject:     user.ID,
+		Email:       user.Email,
+		Activated:   user.Activated,
+		Permissions: permissions,
+		IssuedAt:    time.Now().Unix(),
+		Expiry:      access.Expiry.Unix(),
+	}
+	if access.ClientID != nil {
+		claims.ClientID = *access.ClientID
+	}
+	signed, err := app.signingKeys.Sign(claims)
+	if err != nil {
+		return err
+	}
+	access.Plaintext = signed
+	return nil
+}
+
+// denySessions() puts the signed tokens of the given sessions on the denylist.
+// It does nothing in database mode where deleting the row is enough
+func (app *application) denySessions(ids ...int64) error {
+	if app.config.tokens.mode != "signed" {
+		return nil
+	}
+	expiry := time.Now().Add(app.config.tokens.accessTTL)
+	for _, id := range ids {
+		err := app.revokeSignedToken(strconv.FormatInt(id, 10), expiry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// denyUserSessions() denies the signed tokens of every session a user has,
+// plus any extra session ids whose rows may already be gone
+func (app *application) denyUserSessions(userID int64, extra ...int64) error {
+	if app.config.tokens.mode != "signed" {
+		return nil
+	}
+	tokens, err := app.models.Tokens.GetAllForUser(data.ScopeAuthentication, userID)
+	if err != nil {
+		return err
+	}
+	ids := extra
+	for i := range tokens {
+		ids = append(ids, tokens[i].ID)
 	}
+	return app.denySessions(ids...)
 }
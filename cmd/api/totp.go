@@ -0,0 +1,147 @@
+// Filename: cmd/api/totp.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"forum.kevin.net/internal/data"
+	"forum.kevin.net/internal/totp"
+	"forum.kevin.net/internal/validator"
+)
+
+// Start enrollment by generating a new secret for the current user
+func (app *application) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if len(app.config.totp.key) == 0 {
+		app.totpNotConfiguredResponse(w, r)
+		return
+	}
+	user := app.contextGetUser(r)
+	// Generate and encrypt the secret
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	encrypted, err := totp.Encrypt(app.config.totp.key, secret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.TOTP.Insert(user.ID, encrypted)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTOTPAlreadyEnabled):
+			app.totpAlreadyEnabledResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// The secret is only ever shown here
+	env := envelope{
+		"totp": map[string]string{
+			"secret": secret,
+			"uri":    totp.URI(app.config.totp.issuer, user.Email, secret),
+		},
+	}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Finish enrollment with a first code and return the recovery codes
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if len(app.config.totp.key) == 0 {
+		app.totpNotConfiguredResponse(w, r)
+		return
+	}
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user := app.contextGetUser(r)
+	// Get the pending secret
+	settings, err := app.models.TOTP.GetForUser(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundReponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if settings.Confirmed {
+		app.totpAlreadyEnabledResponse(w, r)
+		return
+	}
+	secret, err := totp.Decrypt(app.config.totp.key, settings.SecretEncrypted)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	step, ok, err := totp.Validate(secret, input.Code, time.Now())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		v.AddError("code", "invalid or expired code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	codes, err := app.models.TOTP.Confirm(user.ID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTOTPAlreadyEnabled):
+			app.totpAlreadyEnabledResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.audit(r, "totp.enable", "user", user.ID, nil, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// verifySecondFactor() checks either a TOTP code or a recovery code
+func (app *application) verifySecondFactor(userID int64, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return app.models.TOTP.UseRecoveryCode(userID, recoveryCode)
+	}
+	settings, err := app.models.TOTP.GetForUser(userID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !settings.Confirmed {
+		return false, nil
+	}
+	secret, err := totp.Decrypt(app.config.totp.key, settings.SecretEncrypted)
+	if err != nil {
+		return false, err
+	}
+	step, ok, err := totp.Validate(secret, code, time.Now())
+	if err != nil || !ok {
+		return false, err
+	}
+	// Refuse a code that has already been used
+	return app.models.TOTP.UseStep(userID, step)
+}
@@ -40,7 +40,8 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	err = app.models.Users.Insert(user)
+	//Insert the user along with the default role
+	err = app.models.Users.Insert(user, app.config.roles.defaultRole)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -51,13 +52,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 		return
 	}
-
-	//Add permissions for the newly inserted user
-	err = app.models.Permissions.AddForUser(user.ID, "forum:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
+	app.audit(r, "user.create", "user", user.ID, nil, user)
 
 	//Generate a token for the new user
 	token, err := app.models.Tokens.New(user.ID, 1*24*time.Hour, data.ScopeActivation)
@@ -72,9 +67,9 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 			"userID":          user.ID,
 		}
 		//Send the email
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
+		err = app.sendMail(user.Email, "user_welcome.tmpl", data)
 		if err != nil {
-			app.logger.PrintError(err, nil)
+			app.requestLogger(r).PrintError(err, nil)
 			return
 		}
 	})
@@ -116,6 +111,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 	//Update the user status
+	original := *user
 	user.Activated = true
 	//Save the updated users record
 	err = app.models.Users.Update(user)
@@ -128,6 +124,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 		return
 	}
+	app.audit(app.contextSetUser(r, user), "user.activate", "user", user.ID, original, user)
 	//Delete the user's token
 	err = app.models.Tokens.DeleteAllForUsers(data.ScopeActivation, user.ID)
 	if err != nil {
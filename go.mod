@@ -6,7 +6,6 @@ require (
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/lib/pq v1.10.7
 	golang.org/x/crypto v0.2.0
-	golang.org/x/time v0.2.0
 	gopkg.in/mail.v2 v2.3.1
 )
 
@@ -0,0 +1,143 @@
+// Filename: internal/cache/cache.go
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An entry holds a value until it expires
+type entry[K comparable, V any] struct {
+	key    K
+	value  V
+	expiry time.Time
+}
+
+// Cache is a bounded, concurrency-safe TTL cache. When it is full the least
+// recently used entry is evicted
+type Cache[K comparable, V any] struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	items      map[K]*list.Element
+	order      *list.List // front is most recently used
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+	evictions  atomic.Uint64
+}
+
+// The New() function creates a cache holding at most maxEntries values for ttl each
+func New[K comparable, V any](maxEntries int, ttl time.Duration) *Cache[K, V] {
+	return &Cache[K, V]{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		items:      make(map[K]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Get() returns the value for key if it is present and has not expired
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	element, found := c.items[key]
+	if !found {
+		c.misses.Add(1)
+		return zero, false
+	}
+	e := element.Value.(*entry[K, V])
+	if time.Now().After(e.expiry) {
+		c.removeElement(element)
+		c.misses.Add(1)
+		return zero, false
+	}
+	c.order.MoveToFront(element)
+	c.hits.Add(1)
+	return e.value, true
+}
+
+// Set() adds or replaces the value for key
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiry := time.Now().Add(c.ttl)
+	if element, found := c.items[key]; found {
+		e := element.Value.(*entry[K, V])
+		e.value = value
+		e.expiry = expiry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.items[key] = c.order.PushFront(&entry[K, V]{key: key, value: value, expiry: expiry})
+	// Evict the least recently used entry once we are over the limit
+	for c.order.Len() > c.maxEntries {
+		c.removeElement(c.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// Update() changes the value for key in place without extending its life.
+// It does nothing if the key is not cached
+func (c *Cache[K, V]) Update(key K, fn func(V) V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, found := c.items[key]; found {
+		e := element.Value.(*entry[K, V])
+		e.value = fn(e.value)
+	}
+}
+
+// Delete() removes the value for key
+func (c *Cache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, found := c.items[key]; found {
+		c.removeElement(element)
+	}
+}
+
+// DeleteFunc() removes every entry for which fn returns true
+func (c *Cache[K, V]) DeleteFunc(fn func(key K, value V) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, element := range c.items {
+		if fn(key, element.Value.(*entry[K, V]).value) {
+			c.removeElement(element)
+		}
+	}
+}
+
+// Purge() removes every entry
+func (c *Cache[K, V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = make(map[K]*list.Element)
+	c.order.Init()
+}
+
+// Len() returns the number of entries, including expired ones not yet evicted
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Stats() returns the hit, miss and eviction counters. Evictions only count
+// entries pushed out to make room, not expired or deleted ones
+func (c *Cache[K, V]) Stats() (hits, misses, evictions uint64) {
+	return c.hits.Load(), c.misses.Load(), c.evictions.Load()
+}
+
+func (c *Cache[K, V]) removeElement(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.items, element.Value.(*entry[K, V]).key)
+}
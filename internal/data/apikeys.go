@@ -0,0 +1,254 @@
+// Filename: internal/data/apikeys.go
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"forum.kevin.net/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Every API key starts with this prefix so leaked keys are easy to spot
+const apiKeyPrefix = "fk_"
+
+type APIKey struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"createdat"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	UserID      int64       `json:"user_id"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry,omitempty"`
+	IPAllowlist []string    `json:"ip_allowlist"`
+	LastUsedAt  *time.Time  `json:"last_used_at,omitempty"`
+}
+
+// AllowsIP() reports whether the key may be used from ip. An empty
+// allowlist allows every address
+func (k *APIKey) AllowsIP(ip string) bool {
+	if len(k.IPAllowlist) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, entry := range k.IPAllowlist {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(addr) {
+				return true
+			}
+			continue
+		}
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) > 0, "permissions", "must contain at least one permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+	for _, entry := range key.IPAllowlist {
+		_, _, err := net.ParseCIDR(entry)
+		v.Check(err == nil || net.ParseIP(entry) != nil, "ip_allowlist", "must only contain IP addresses or CIDR ranges")
+	}
+}
+
+// Check that the plaintext key has the right shape
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(strings.HasPrefix(keyPlaintext, apiKeyPrefix), "key", "must be a valid API key")
+}
+
+// The generateAPIKey() function fills in the plaintext and hash of a key
+func generateAPIKey(key *APIKey) error {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	key.Plaintext = apiKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	key.Hash = HashTokenPlaintext(key.Plaintext)
+	return nil
+}
+
+// Define the APIKey model
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// Generate and insert a new key, the plaintext is only available afterwards
+func (m APIKeyModel) Insert(key *APIKey) error {
+	err := generateAPIKey(key)
+	if err != nil {
+		return err
+	}
+	if key.IPAllowlist == nil {
+		key.IPAllowlist = []string{}
+	}
+	query := `
+		INSERT INTO api_keys (hash, user_id, name, permissions, expiry, ip_allowlist)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, createdat
+	`
+	args := []interface{}{
+		key.Hash,
+		key.UserID,
+		key.Name,
+		pq.Array([]string(key.Permissions)),
+		key.Expiry,
+		pq.Array(key.IPAllowlist),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// Get an unexpired key and the user it belongs to. A service account counts
+// as suspended while its owner is
+func (m APIKeyModel) GetForKey(keyPlaintext string) (*APIKey, *User, error) {
+	query := `
+		SELECT api_keys.id, api_keys.createdat, api_keys.user_id, api_keys.name,
+		api_keys.permissions, api_keys.expiry, api_keys.ip_allowlist, api_keys.last_used_at,
+		users.id, users.createdat, users.name, users.email,
+		users.password_hash, users.activated, users.version, users.service_account,
+		(` + suspendedColumn + ` OR ` + ownerSuspendedColumn + `)
+		FROM api_keys
+		INNER JOIN users
+		ON users.id = api_keys.user_id
+		WHERE api_keys.hash = $1
+		AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)
+	`
+	var key APIKey
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, HashTokenPlaintext(keyPlaintext), time.Now()).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.UserID,
+		&key.Name,
+		pq.Array((*[]string)(&key.Permissions)),
+		&key.Expiry,
+		pq.Array(&key.IPAllowlist),
+		&key.LastUsedAt,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.ServiceAccount,
+		&user.Suspended,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	return &key, &user, nil
+}
+
+// Get the keys of a user and of the service accounts that user owns
+func (m APIKeyModel) GetAllForOwner(ownerID int64) ([]*APIKey, error) {
+	query := `
+		SELECT api_keys.id, api_keys.createdat, api_keys.user_id, api_keys.name,
+		api_keys.permissions, api_keys.expiry, api_keys.ip_allowlist, api_keys.last_used_at
+		FROM api_keys
+		INNER JOIN users
+		ON users.id = api_keys.user_id
+		WHERE users.id = $1 OR users.owner_id = $1
+		ORDER BY api_keys.id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.UserID,
+			&key.Name,
+			pq.Array((*[]string)(&key.Permissions)),
+			&key.Expiry,
+			pq.Array(&key.IPAllowlist),
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Record that a key was just used
+func (m APIKeyModel) Touch(id int64) error {
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// Revoke a key that belongs to the owner or to one of the owner's service accounts
+func (m APIKeyModel) DeleteForOwner(ownerID int64, id int64) error {
+	query := `
+		DELETE FROM api_keys
+		USING users
+		WHERE users.id = api_keys.user_id
+		AND api_keys.id = $2
+		AND (users.id = $1 OR users.owner_id = $1)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, ownerID, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
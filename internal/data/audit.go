@@ -0,0 +1,225 @@
+// Filename: internal/data/audit.go
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// An AuditEvent records who changed what. Before and After only hold the
+// fields that changed
+type AuditEvent struct {
+	ID         int64                  `json:"id"`
+	CreatedAt  time.Time              `json:"createdat"`
+	ActorID    *int64                 `json:"actor_id"`
+	Action     string                 `json:"action"`
+	TargetType string                 `json:"target_type"`
+	TargetID   *int64                 `json:"target_id"`
+	Details    map[string]interface{} `json:"details"`
+	Before     map[string]interface{} `json:"before"`
+	After      map[string]interface{} `json:"after"`
+	IP         string                 `json:"ip"`
+	RequestID  string                 `json:"request_id"`
+}
+
+// An AuditFilter narrows a search of the log, zero values match everything
+type AuditFilter struct {
+	ActorID    int64
+	Action     string
+	TargetType string
+	TargetID   int64
+	From       time.Time
+	To         time.Time
+}
+
+// SetDiff() fills Before and After with the JSON fields that differ between
+// two versions of a record. Either may be nil for a create or a delete
+func (e *AuditEvent) SetDiff(before, after interface{}) error {
+	b, err := toJSONObject(before)
+	if err != nil {
+		return err
+	}
+	a, err := toJSONObject(after)
+	if err != nil {
+		return err
+	}
+	if b == nil || a == nil {
+		e.Before, e.After = b, a
+		return nil
+	}
+	e.Before = map[string]interface{}{}
+	e.After = map[string]interface{}{}
+	for key, value := range b {
+		if !reflect.DeepEqual(value, a[key]) {
+			e.Before[key] = value
+		}
+	}
+	for key, value := range a {
+		if !reflect.DeepEqual(value, b[key]) {
+			e.After[key] = value
+		}
+	}
+	return nil
+}
+
+// The toJSONObject() function turns a record into the object its JSON
+// encoding would be, so hidden fields stay hidden
+func toJSONObject(record interface{}) (map[string]interface{}, error) {
+	if record == nil || reflect.ValueOf(record).Kind() == reflect.Ptr && reflect.ValueOf(record).IsNil() {
+		return nil, nil
+	}
+	js, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]interface{}
+	err = json.Unmarshal(js, &object)
+	return object, err
+}
+
+// Define the Audit model
+type AuditModel struct {
+	DB *sql.DB
+}
+
+// Record an event on its own
+func (m AuditModel) Insert(event *AuditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return insertAuditEvent(ctx, m.DB, event)
+}
+
+// Write paths that must not change anything without a record call this
+// inside their own transaction
+func insertAuditEvent(ctx context.Context, db queryRower, event *AuditEvent) error {
+	query := `
+		INSERT INTO audit_events (actor_id, action, target_type, target_id, details, before, after, ip, request_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, createdat
+	`
+	details := event.Details
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	js, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	before, err := nullableJSON(event.Before)
+	if err != nil {
+		return err
+	}
+	after, err := nullableJSON(event.After)
+	if err != nil {
+		return err
+	}
+	args := []interface{}{event.ActorID, event.Action, event.TargetType, event.TargetID, js, before, after, event.IP, event.RequestID}
+	return db.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// A nil object is stored as NULL rather than the JSON null
+func nullableJSON(object map[string]interface{}) ([]byte, error) {
+	if object == nil {
+		return nil, nil
+	}
+	return json.Marshal(object)
+}
+
+// A NULL column is read back as a nil object
+func unmarshalObject(js []byte) (map[string]interface{}, error) {
+	if js == nil {
+		return nil, nil
+	}
+	var object map[string]interface{}
+	err := json.Unmarshal(js, &object)
+	return object, err
+}
+
+// A zero time is passed as NULL
+func nullableTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Search the log, newest first unless filters say otherwise
+func (m AuditModel) GetAll(filter AuditFilter, filters Filters) ([]*AuditEvent, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(),
+		id, createdat, actor_id, action, target_type, target_id, details, before, after, ip, request_id
+		FROM audit_events
+		WHERE (actor_id = $1 OR $1 = 0)
+		AND (action = $2 OR $2 = '')
+		AND (target_type = $3 OR $3 = '')
+		AND (target_id = $4 OR $4 = 0)
+		AND (createdat >= $5 OR $5::timestamptz IS NULL)
+		AND (createdat < $6 OR $6::timestamptz IS NULL)
+		ORDER BY %s %s, id DESC
+		LIMIT $7 OFFSET $8`, filters.sortColumn(), filters.sortOrder())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{
+		filter.ActorID,
+		filter.Action,
+		filter.TargetType,
+		filter.TargetID,
+		nullableTime(filter.From),
+		nullableTime(filter.To),
+		filters.limit(),
+		filters.offSet(),
+	}
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*AuditEvent{}
+	for rows.Next() {
+		var event AuditEvent
+		var details, before, after []byte
+		err := rows.Scan(
+			&totalRecords,
+			&event.ID,
+			&event.CreatedAt,
+			&event.ActorID,
+			&event.Action,
+			&event.TargetType,
+			&event.TargetID,
+			&details,
+			&before,
+			&after,
+			&event.IP,
+			&event.RequestID,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		event.Details, err = unmarshalObject(details)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		event.Before, err = unmarshalObject(before)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		event.After, err = unmarshalObject(after)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		events = append(events, &event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	return events, metadata, nil
+}
@@ -0,0 +1,171 @@
+// Filename: internal/data/authcache.go
+package data
+
+import (
+	"sync"
+	"time"
+
+	"forum.kevin.net/internal/cache"
+)
+
+// A cachedSession is what GetForAuthenticationToken() resolved for a token
+type cachedSession struct {
+	user  User
+	token Token
+}
+
+// AuthCache sits in front of the two lookups every authenticated request
+// makes: token to user, and user to permissions. The models keep it in step
+// with their own writes. It is per process, so changes made by another
+// instance are only picked up once entries expire. A nil *AuthCache is a
+// valid, disabled cache
+//
+// A lookup that misses reads the database and then fills the cache. If a
+// write invalidates entries while that read is in flight, the fill would put
+// back what was just removed. Each invalidation therefore bumps a generation
+// counter, and a fill is dropped when the generation it started under is gone
+type AuthCache struct {
+	mu                   sync.Mutex
+	sessions             *cache.Cache[string, cachedSession]
+	sessionGeneration    uint64
+	permissions          *cache.Cache[int64, Permissions]
+	permissionGeneration uint64
+}
+
+// The NewAuthCache() function creates a cache holding at most maxEntries of
+// each kind for ttl
+func NewAuthCache(maxEntries int, ttl time.Duration) *AuthCache {
+	return &AuthCache{
+		sessions:    cache.New[string, cachedSession](maxEntries, ttl),
+		permissions: cache.New[int64, Permissions](maxEntries, ttl),
+	}
+}
+
+// Stats() returns the counters of both caches
+func (c *AuthCache) Stats() map[string]uint64 {
+	if c == nil {
+		return nil
+	}
+	sessionHits, sessionMisses, sessionEvictions := c.sessions.Stats()
+	permissionHits, permissionMisses, permissionEvictions := c.permissions.Stats()
+	return map[string]uint64{
+		"session_hits":         sessionHits,
+		"session_misses":       sessionMisses,
+		"session_evictions":    sessionEvictions,
+		"session_entries":      uint64(c.sessions.Len()),
+		"permission_hits":      permissionHits,
+		"permission_misses":    permissionMisses,
+		"permission_evictions": permissionEvictions,
+		"permission_entries":   uint64(c.permissions.Len()),
+	}
+}
+
+// getSession() also returns the current generation, which the caller hands
+// back to setSession() after reading the database
+func (c *AuthCache) getSession(hash []byte) (*User, *Token, uint64, bool) {
+	if c == nil {
+		return nil, nil, 0, false
+	}
+	c.mu.Lock()
+	generation := c.sessionGeneration
+	c.mu.Unlock()
+	session, found := c.sessions.Get(string(hash))
+	// Never serve a token past its own expiry
+	if !found || time.Now().After(session.token.Expiry) {
+		return nil, nil, generation, false
+	}
+	return &session.user, &session.token, generation, true
+}
+
+// setSession() caches a lookup unless sessions were invalidated since generation
+func (c *AuthCache) setSession(user *User, token *Token, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.sessionGeneration {
+		return
+	}
+	c.sessions.Set(string(token.Hash), cachedSession{user: *user, token: *token})
+}
+
+func (c *AuthCache) touchSession(hash []byte, lastUsedAt time.Time) {
+	if c == nil {
+		return
+	}
+	c.sessions.Update(string(hash), func(session cachedSession) cachedSession {
+		session.token.LastUsedAt = lastUsedAt
+		return session
+	})
+}
+
+// Forget every cached token of a user
+func (c *AuthCache) deleteSessionsForUser(userID int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessionGeneration++
+	c.sessions.DeleteFunc(func(_ string, session cachedSession) bool {
+		return session.user.ID == userID
+	})
+}
+
+// Forget every cached token issued to an OAuth client
+func (c *AuthCache) deleteSessionsForClient(clientID int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessionGeneration++
+	c.sessions.DeleteFunc(func(_ string, session cachedSession) bool {
+		return session.token.ClientID != nil && *session.token.ClientID == clientID
+	})
+}
+
+func (c *AuthCache) purgeSessions() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessionGeneration++
+	c.sessions.Purge()
+}
+
+// getPermissions() works like getSession(), returning the generation too
+func (c *AuthCache) getPermissions(userID int64) (Permissions, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	generation := c.permissionGeneration
+	c.mu.Unlock()
+	permissions, found := c.permissions.Get(userID)
+	return permissions, generation, found
+}
+
+func (c *AuthCache) setPermissions(userID int64, permissions Permissions, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.permissionGeneration {
+		return
+	}
+	c.permissions.Set(userID, permissions)
+}
+
+func (c *AuthCache) deletePermissions(userID int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.permissionGeneration++
+	c.permissions.Delete(userID)
+}
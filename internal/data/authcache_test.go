@@ -0,0 +1,38 @@
+// Filename: internal/data/authcache_test.go
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthCacheDropsStaleFills(t *testing.T) {
+	c := NewAuthCache(10, time.Minute)
+	user := &User{ID: 1}
+	token := &Token{Hash: []byte("hash"), UserID: 1, Expiry: time.Now().Add(time.Hour)}
+
+	// A lookup misses and goes to the database; the token is revoked meanwhile
+	_, _, generation, found := c.getSession(token.Hash)
+	if found {
+		t.Fatal("empty cache reported a session")
+	}
+	c.deleteSessionsForUser(user.ID)
+	c.setSession(user, token, generation)
+	if _, _, _, found := c.getSession(token.Hash); found {
+		t.Error("session filled after an invalidation was cached")
+	}
+
+	// A fill that did not race an invalidation is kept
+	_, _, generation, _ = c.getSession(token.Hash)
+	c.setSession(user, token, generation)
+	if _, _, _, found := c.getSession(token.Hash); !found {
+		t.Error("session was not cached")
+	}
+
+	_, generation, _ = c.getPermissions(user.ID)
+	c.deletePermissions(user.ID)
+	c.setPermissions(user.ID, Permissions{"forums:read"}, generation)
+	if _, _, found := c.getPermissions(user.ID); found {
+		t.Error("permissions filled after an invalidation were cached")
+	}
+}
@@ -0,0 +1,77 @@
+// Filename: internal/data/denylist.go
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Define the Denylist model
+type DenylistModel struct {
+	DB *sql.DB
+}
+
+// Add a token id to the denylist until the token would have expired anyway
+func (m DenylistModel) Insert(jti string, expiry time.Time) error {
+	query := `
+		INSERT INTO token_denylist (jti, expiry)
+		VALUES ($1, $2)
+		ON CONFLICT (jti) DO NOTHING
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, jti, expiry)
+	return err
+}
+
+// Get every entry that still matters
+func (m DenylistModel) GetAllActive() (map[string]time.Time, error) {
+	query := `
+		SELECT jti, expiry
+		FROM token_denylist
+		WHERE expiry > $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[string]time.Time)
+	for rows.Next() {
+		var jti string
+		var expiry time.Time
+		err := rows.Scan(&jti, &expiry)
+		if err != nil {
+			return nil, err
+		}
+		entries[jti] = expiry
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Delete up to batchSize entries for tokens that have expired anyway
+func (m DenylistModel) DeleteExpired(batchSize int) (int64, error) {
+	query := `
+		DELETE FROM token_denylist
+		WHERE jti IN (
+			SELECT jti FROM token_denylist
+			WHERE expiry < $1
+			LIMIT $2
+		)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, time.Now(), batchSize)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -20,6 +20,8 @@ type Forum struct {
 	Description string    `json:"description"`
 	Publisher   string    `json:"publisher"`
 	ReleaseDate int       `json:"releasedate"`
+	UserID      *int64    `json:"user_id,omitempty"` // the author, if still around
+	Hidden      bool      `json:"hidden"`
 	Version     int32     `json:"version"`
 }
 
@@ -46,12 +48,12 @@ type ForumModel struct {
 // Insert() allows us to create a new forum
 func (m ForumModel) Insert(forum *Forum) error {
 	query := `
-		INSERT INTO forums (title, category, description, publisher, releasedate)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO forums (title, category, description, publisher, releasedate, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
 		RETURNING id, createdat, version
 	`
 	//collect the date field into a slice
-	args := []interface{}{forum.Title, forum.Category, forum.Description, forum.Publisher, forum.ReleaseDate}
+	args := []interface{}{forum.Title, forum.Category, forum.Description, forum.Publisher, forum.ReleaseDate, forum.UserID}
 	//creating the context
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	//Clean up to prevent memory leaks
@@ -69,7 +71,7 @@ func (m ForumModel) Get(id int64) (*Forum, error) {
 
 	//Construct our query with the given id
 	query := `
-		SELECT id, createdat, title, category, description, publisher, releasedate, version
+		SELECT id, createdat, title, category, description, publisher, releasedate, user_id, hidden, version
 		FROM forums
 		WHERE id = $1
 	`
@@ -90,6 +92,8 @@ func (m ForumModel) Get(id int64) (*Forum, error) {
 		&forum.Description,
 		&forum.Publisher,
 		&forum.ReleaseDate,
+		&forum.UserID,
+		&forum.Hidden,
 		&forum.Version,
 	)
 
@@ -148,7 +152,9 @@ func (m ForumModel) Update(forum *Forum) error {
 
 }
 
-func (m ForumModel) Delete(id int64) error {
+// Delete() removes a forum, but only at the given version so a forum that
+// changed since it was fetched is not lost
+func (m ForumModel) Delete(id int64, version int32) error {
 	//Ensure that there is a valid id
 	if id < 1 {
 		return ErrRecordNotFound
@@ -157,6 +163,7 @@ func (m ForumModel) Delete(id int64) error {
 	query := `
 		DELETE FROM forums
 		WHERE id = $1
+		AND version = $2
 	`
 
 	//creating the context
@@ -165,7 +172,7 @@ func (m ForumModel) Delete(id int64) error {
 	defer cancel()
 
 	//Execute the query
-	result, err := m.DB.ExecContext(ctx, query, id)
+	result, err := m.DB.ExecContext(ctx, query, id, version)
 	if err != nil {
 		return err
 	}
@@ -177,9 +184,10 @@ func (m ForumModel) Delete(id int64) error {
 		return err
 	}
 
-	//Check if no rows were affected
+	//Check if no rows were affected, the forum was changed or deleted
+	//after it was fetched
 	if rowsAffected == 0 {
-		return ErrRecordNotFound
+		return ErrEditConflict
 	}
 	return nil
 }
@@ -188,9 +196,10 @@ func (m ForumModel) GetAll(title string, category string, description string, fi
 	//constructing the query
 	query := fmt.Sprintf(`
 		SELECT COUNT(*) OVER(),
-	    id, createdat, title, category, description, publisher, releasedate, version
+	    id, createdat, title, category, description, publisher, releasedate, user_id, hidden, version
 		FROM forums
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		WHERE NOT hidden
+		AND (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
 		AND (to_tsvector('simple', category) @@ plainto_tsquery('simple', $2) OR $2 = '')
 		AND (to_tsvector('simple', description) @@ plainto_tsquery('simple', $3) OR $3 = '')
 		ORDER BY %s %s, id ASC
@@ -228,6 +237,8 @@ func (m ForumModel) GetAll(title string, category string, description string, fi
 			&forum.Description,
 			&forum.Publisher,
 			&forum.ReleaseDate,
+			&forum.UserID,
+			&forum.Hidden,
 			&forum.Version,
 		)
 		if err != nil {
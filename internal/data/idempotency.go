@@ -0,0 +1,160 @@
+// Filename: internal/data/idempotency.go
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"forum.kevin.net/internal/validator"
+)
+
+// How long the request holding a key has to finish before a retry may take
+// the key over, longer than the server's write timeout
+const IdempotencyLockTTL = time.Minute
+
+// An IdempotencyKey remembers the response to a request so a retry with the
+// same key gets the same answer instead of repeating the change
+type IdempotencyKey struct {
+	UserID      int64
+	Key         string
+	Expiry      time.Time
+	LockedUntil time.Time           // tells one reservation of the key from the next
+	Fingerprint []byte              // hash of the request the key was first used with
+	Status      int                 // zero while the first request is being served
+	Header      map[string][]string // the response headers worth replaying
+	Body        []byte
+}
+
+func ValidateIdempotencyKey(v *validator.Validator, key string) {
+	v.Check(len(key) <= 255, "idempotency_key", "must not be more than 255 bytes long")
+	for _, c := range key {
+		if c < 0x21 || c > 0x7e {
+			v.AddError("idempotency_key", "must only contain visible ASCII characters")
+			break
+		}
+	}
+}
+
+// Define the IdempotencyKey model
+type IdempotencyKeyModel struct {
+	DB *sql.DB
+}
+
+// Reserve() claims a key for a new request and returns the reservation,
+// with reserved true. When the key is already taken it returns the existing
+// entry instead. Expired keys, and keys whose request never finished within
+// its lock, are claimed again as if they were new
+func (m IdempotencyKeyModel) Reserve(userID int64, key string, fingerprint []byte, ttl time.Duration) (entry *IdempotencyKey, reserved bool, err error) {
+	query := `
+		INSERT INTO idempotency_keys (user_id, key, expiry, locked_until, fingerprint)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET createdat = NOW(), expiry = EXCLUDED.expiry, locked_until = EXCLUDED.locked_until,
+		fingerprint = EXCLUDED.fingerprint, status = NULL, header = '{}', body = ''
+		WHERE idempotency_keys.expiry < NOW()
+		OR (idempotency_keys.status IS NULL AND idempotency_keys.locked_until < NOW())
+		RETURNING locked_until
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	entry = &IdempotencyKey{UserID: userID, Key: key, Expiry: now.Add(ttl), Fingerprint: fingerprint}
+	args := []interface{}{userID, key, entry.Expiry, now.Add(IdempotencyLockTTL), fingerprint}
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&entry.LockedUntil)
+	switch {
+	case err == nil:
+		return entry, true, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, false, err
+	}
+
+	query = `
+		SELECT expiry, locked_until, fingerprint, status, header, body
+		FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2
+	`
+	existing := &IdempotencyKey{UserID: userID, Key: key}
+	var status sql.NullInt32
+	var header []byte
+	err = m.DB.QueryRowContext(ctx, query, userID, key).Scan(
+		&existing.Expiry,
+		&existing.LockedUntil,
+		&existing.Fingerprint,
+		&status,
+		&header,
+		&existing.Body,
+	)
+	if err != nil {
+		switch {
+		// Released by the request holding it in the meantime
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, false, ErrEditConflict
+		default:
+			return nil, false, err
+		}
+	}
+	existing.Status = int(status.Int32)
+	err = json.Unmarshal(header, &existing.Header)
+	if err != nil {
+		return nil, false, err
+	}
+	return existing, false, nil
+}
+
+// Complete() stores the response to the request that holds a reservation.
+// If the lock ran out and a retry took the key over, the retry's response
+// wins and this one is dropped
+func (m IdempotencyKeyModel) Complete(reservation *IdempotencyKey, status int, header map[string][]string, body []byte) error {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	query := `
+		UPDATE idempotency_keys
+		SET status = $4, header = $5, body = $6
+		WHERE user_id = $1 AND key = $2 AND locked_until = $3 AND status IS NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{reservation.UserID, reservation.Key, reservation.LockedUntil, status, headerJSON, body}
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Release() gives up a reservation whose request failed, so it can be
+// retried. A retry that already took the key over keeps it
+func (m IdempotencyKeyModel) Release(reservation *IdempotencyKey) error {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2 AND locked_until = $3 AND status IS NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, reservation.UserID, reservation.Key, reservation.LockedUntil)
+	return err
+}
+
+// DeleteExpired() removes up to batchSize keys past their expiry
+func (m IdempotencyKeyModel) DeleteExpired(batchSize int) (int64, error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE (user_id, key) IN (
+			SELECT user_id, key FROM idempotency_keys
+			WHERE expiry < $1
+			LIMIT $2
+		)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, time.Now(), batchSize)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
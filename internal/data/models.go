@@ -13,18 +13,45 @@ var (
 
 // A wrapper for out data models
 type Models struct {
-	Permissions PermissionModel
-	Forums      ForumModel
-	Users       UserModel
-	Tokens      TokenModel
+	AuthCache       *AuthCache
+	APIKeys         APIKeyModel
+	Audit           AuditModel
+	Denylist        DenylistModel
+	Permissions     PermissionModel
+	Forums          ForumModel
+	IdempotencyKeys IdempotencyKeyModel
+	OAuthClients    OAuthClientModel
+	OAuthCodes      OAuthCodeModel
+	Reports         ReportModel
+	Roles           RoleModel
+	Users           UserModel
+	Tokens          TokenModel
+	TOTP            TOTPModel
+	ServiceAccounts ServiceAccountModel
+	Suspensions     SuspensionModel
+	Warnings        WarningModel
 }
 
-// NewModels() allows us to create a new model
-func NewModels(db *sql.DB) Models {
+// NewModels() allows us to create a new model. authCache may be nil to
+// disable caching
+func NewModels(db *sql.DB, authCache *AuthCache) Models {
 	return Models{
-		Permissions: PermissionModel{DB: db},
-		Forums:      ForumModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
+		AuthCache:       authCache,
+		APIKeys:         APIKeyModel{DB: db},
+		Audit:           AuditModel{DB: db},
+		Denylist:        DenylistModel{DB: db},
+		Permissions:     PermissionModel{DB: db, Cache: authCache},
+		Forums:          ForumModel{DB: db},
+		IdempotencyKeys: IdempotencyKeyModel{DB: db},
+		OAuthClients:    OAuthClientModel{DB: db},
+		OAuthCodes:      OAuthCodeModel{DB: db},
+		Reports:         ReportModel{DB: db},
+		Roles:           RoleModel{DB: db, Cache: authCache},
+		Users:           UserModel{DB: db, Cache: authCache},
+		Tokens:          TokenModel{DB: db, Cache: authCache},
+		TOTP:            TOTPModel{DB: db},
+		ServiceAccounts: ServiceAccountModel{DB: db},
+		Suspensions:     SuspensionModel{DB: db, Cache: authCache},
+		Warnings:        WarningModel{DB: db},
 	}
 }
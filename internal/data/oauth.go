@@ -0,0 +1,315 @@
+// Filename: internal/data/oauth.go
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"forum.kevin.net/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Characters allowed in a PKCE code verifier (RFC 7636 section 4.1)
+var codeVerifierRX = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+type OAuthClient struct {
+	ID           int64     `json:"-"`
+	CreatedAt    time.Time `json:"createdat"`
+	ClientID     string    `json:"client_id"`
+	Secret       string    `json:"client_secret,omitempty"`
+	SecretHash   []byte    `json:"-"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	OwnerID      int64     `json:"-"`
+}
+
+// Redirect URIs must match a registered one exactly
+func (c *OAuthClient) AllowsRedirect(redirectURI string) bool {
+	return validator.In(redirectURI, c.RedirectURIs...)
+}
+
+// Public clients have no secret and rely on PKCE alone
+func (c *OAuthClient) SecretMatches(secret string) bool {
+	if !c.Confidential {
+		return secret == ""
+	}
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], c.SecretHash) == 1
+}
+
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(client.RedirectURIs) > 0, "redirect_uris", "must contain at least one URI")
+	v.Check(len(client.RedirectURIs) <= 10, "redirect_uris", "must not contain more than 10 URIs")
+	v.Check(validator.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+	for _, redirectURI := range client.RedirectURIs {
+		v.Check(validRedirectURI(redirectURI), "redirect_uris", "must be absolute https URIs without a fragment, or http on a loopback address")
+	}
+}
+
+// validRedirectURI() only allows plain http for loopback addresses so native
+// apps can listen locally
+func validRedirectURI(redirectURI string) bool {
+	u, err := url.Parse(redirectURI)
+	if err != nil || !u.IsAbs() || u.Fragment != "" || u.Host == "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		ip := net.ParseIP(host)
+		return host == "localhost" || (ip != nil && ip.IsLoopback())
+	default:
+		return false
+	}
+}
+
+func randomString(n int) (string, error) {
+	randomBytes := make([]byte, n)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)), nil
+}
+
+// Define the OAuthClient model
+type OAuthClientModel struct {
+	DB *sql.DB
+}
+
+// Register a client, confidential clients also get a secret
+func (m OAuthClientModel) Insert(client *OAuthClient) error {
+	clientID, err := randomString(16)
+	if err != nil {
+		return err
+	}
+	client.ClientID = clientID
+	if client.Confidential {
+		client.Secret, err = randomString(32)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256([]byte(client.Secret))
+		client.SecretHash = hash[:]
+	}
+	query := `
+		INSERT INTO oauth_clients (client_id, secret_hash, name, redirect_uris, owner_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, createdat
+	`
+	args := []interface{}{
+		client.ClientID,
+		client.SecretHash,
+		client.Name,
+		pq.Array(client.RedirectURIs),
+		client.OwnerID,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&client.ID, &client.CreatedAt)
+}
+
+// Get a client by its public client id
+func (m OAuthClientModel) GetByClientID(clientID string) (*OAuthClient, error) {
+	query := `
+		SELECT id, createdat, client_id, secret_hash, name, redirect_uris, owner_id
+		FROM oauth_clients
+		WHERE client_id = $1
+	`
+	var client OAuthClient
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, clientID).Scan(
+		&client.ID,
+		&client.CreatedAt,
+		&client.ClientID,
+		&client.SecretHash,
+		&client.Name,
+		pq.Array(&client.RedirectURIs),
+		&client.OwnerID,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	client.Confidential = client.SecretHash != nil
+	return &client, nil
+}
+
+// Get the clients a user registered
+func (m OAuthClientModel) GetAllForOwner(ownerID int64) ([]*OAuthClient, error) {
+	query := `
+		SELECT id, createdat, client_id, secret_hash, name, redirect_uris, owner_id
+		FROM oauth_clients
+		WHERE owner_id = $1
+		ORDER BY id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+	for rows.Next() {
+		var client OAuthClient
+		err := rows.Scan(
+			&client.ID,
+			&client.CreatedAt,
+			&client.ClientID,
+			&client.SecretHash,
+			&client.Name,
+			pq.Array(&client.RedirectURIs),
+			&client.OwnerID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		client.Confidential = client.SecretHash != nil
+		clients = append(clients, &client)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+type AuthorizationCode struct {
+	Plaintext     string
+	Hash          []byte
+	ClientID      int64
+	UserID        int64
+	RedirectURI   string
+	Scopes        Permissions
+	CodeChallenge string
+	Expiry        time.Time
+}
+
+// Check the verifier against the S256 challenge sent with the authorization request
+func (c *AuthorizationCode) VerifierMatches(verifier string) bool {
+	hash := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(hash[:])
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(c.CodeChallenge)) == 1
+}
+
+func ValidateCodeVerifier(v *validator.Validator, verifier string) {
+	v.Check(verifier != "", "code_verifier", "must be provided")
+	v.Check(validator.Matches(verifier, codeVerifierRX), "code_verifier", "must be 43 to 128 unreserved characters")
+}
+
+func ValidateCodeChallenge(v *validator.Validator, challenge, method string) {
+	v.Check(challenge != "", "code_challenge", "must be provided")
+	v.Check(len(challenge) == 43, "code_challenge", "must be a base64url encoded SHA-256 hash")
+	v.Check(method == "S256", "code_challenge_method", "must be S256")
+}
+
+// Define the OAuthCode model
+type OAuthCodeModel struct {
+	DB *sql.DB
+}
+
+// Create and insert an authorization code
+func (m OAuthCodeModel) New(code *AuthorizationCode, ttl time.Duration) error {
+	token, err := generateToken(code.UserID, ttl, "")
+	if err != nil {
+		return err
+	}
+	code.Plaintext = token.Plaintext
+	code.Hash = token.Hash
+	code.Expiry = token.Expiry
+
+	query := `
+		INSERT INTO oauth_authorization_codes (hash, client_id, user_id, redirect_uri, scopes, code_challenge, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	args := []interface{}{
+		code.Hash,
+		code.ClientID,
+		code.UserID,
+		code.RedirectURI,
+		pq.Array([]string(code.Scopes)),
+		code.CodeChallenge,
+		code.Expiry,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Consume() deletes and returns an unexpired code so it can only be used once
+func (m OAuthCodeModel) Consume(codePlaintext string) (*AuthorizationCode, error) {
+	query := `
+		DELETE FROM oauth_authorization_codes
+		WHERE hash = $1 AND expiry > $2
+		RETURNING client_id, user_id, redirect_uri, scopes, code_challenge, expiry
+	`
+	code := AuthorizationCode{
+		Plaintext: codePlaintext,
+		Hash:      HashTokenPlaintext(codePlaintext),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, code.Hash, time.Now()).Scan(
+		&code.ClientID,
+		&code.UserID,
+		&code.RedirectURI,
+		pq.Array((*[]string)(&code.Scopes)),
+		&code.CodeChallenge,
+		&code.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &code, nil
+}
+
+// Delete up to batchSize authorization codes that were never exchanged
+func (m OAuthCodeModel) DeleteExpired(batchSize int) (int64, error) {
+	query := `
+		DELETE FROM oauth_authorization_codes
+		WHERE hash IN (
+			SELECT hash FROM oauth_authorization_codes
+			WHERE expiry < $1
+			LIMIT $2
+		)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, time.Now(), batchSize)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
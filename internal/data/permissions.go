@@ -6,6 +6,7 @@ import (
 	"database/sql"
 	"time"
 
+	"forum.kevin.net/internal/validator"
 	"github.com/lib/pq"
 )
 
@@ -21,19 +22,52 @@ func (p Permissions) Include(code string) bool {
 	return false
 }
 
+// Check that every code is included
+func (p Permissions) IncludeAll(codes ...string) bool {
+	for i := range codes {
+		if !p.Include(codes[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Intersect() returns the codes found in both slices
+func (p Permissions) Intersect(other Permissions) Permissions {
+	permissions := Permissions{}
+	for i := range p {
+		if other.Include(p[i]) {
+			permissions = append(permissions, p[i])
+		}
+	}
+	return permissions
+}
+
 type PermissionModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *AuthCache
 }
 
+// Get the codes granted to a user directly or through their roles
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	cached, generation, found := m.Cache.getPermissions(userID)
+	if found {
+		return cached, nil
+	}
 	query := `
 		SELECT permissions.code
 		FROM permissions
 		INNER JOIN users_permissions
 		ON users_permissions.permission_id = permissions.id
-		INNER JOIN users
-		ON users_permissions.user_id = users.id
-		WHERE users.id = $1
+		WHERE users_permissions.user_id = $1
+		UNION
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN roles_permissions
+		ON roles_permissions.permission_id = permissions.id
+		INNER JOIN users_roles
+		ON users_roles.role_id = roles_permissions.role_id
+		WHERE users_roles.user_id = $1
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -55,6 +89,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
+	m.Cache.setPermissions(userID, permissions, generation)
 	return permissions, nil
 }
 
@@ -67,5 +102,236 @@ func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	m.Cache.deletePermissions(userID)
 	return err
 }
+
+// Get every permission code that can be granted
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `
+		SELECT code
+		FROM permissions
+		ORDER BY code
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.queryCodes(ctx, query)
+}
+
+// Get only the codes granted to a user directly, which are the ones that
+// can be revoked
+func (m PermissionModel) GetDirectForUser(userID int64) (Permissions, error) {
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions
+		ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1
+		ORDER BY permissions.code
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.queryCodes(ctx, query, userID)
+}
+
+// Grant codes to a user and record it in the audit trail. Both happen or
+// neither does. The event's details get the codes that were actually added
+func (m PermissionModel) GrantForUser(userID int64, codes Permissions, event *AuditEvent) error {
+	query := `
+		WITH granted AS (
+			INSERT INTO users_permissions
+			SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+			ON CONFLICT DO NOTHING
+			RETURNING permission_id
+		)
+		SELECT code FROM permissions
+		WHERE id IN (SELECT permission_id FROM granted)
+		ORDER BY code
+	`
+	return m.changeForUser(query, userID, event, userID, pq.Array([]string(codes)))
+}
+
+// Revoke codes granted directly to a user and record it in the audit trail.
+// Codes that come from the user's roles are not affected
+func (m PermissionModel) RevokeForUser(userID int64, codes Permissions, event *AuditEvent) error {
+	query := `
+		WITH revoked AS (
+			DELETE FROM users_permissions
+			WHERE user_id = $1
+			AND permission_id IN (SELECT id FROM permissions WHERE code = ANY($2))
+			RETURNING permission_id
+		)
+		SELECT code FROM permissions
+		WHERE id IN (SELECT permission_id FROM revoked)
+		ORDER BY code
+	`
+	return m.changeForUser(query, userID, event, userID, pq.Array([]string(codes)))
+}
+
+// Grant codes to a user for a single forum only
+func (m PermissionModel) GrantForUserInForum(userID, forumID int64, codes Permissions, event *AuditEvent) error {
+	query := `
+		WITH granted AS (
+			INSERT INTO users_forum_permissions
+			SELECT $1, permissions.id, $3 FROM permissions WHERE permissions.code = ANY($2)
+			ON CONFLICT DO NOTHING
+			RETURNING permission_id
+		)
+		SELECT code FROM permissions
+		WHERE id IN (SELECT permission_id FROM granted)
+		ORDER BY code
+	`
+	return m.changeForUser(query, userID, event, userID, pq.Array([]string(codes)), forumID)
+}
+
+// Revoke codes a user was granted for a single forum
+func (m PermissionModel) RevokeForUserInForum(userID, forumID int64, codes Permissions, event *AuditEvent) error {
+	query := `
+		WITH revoked AS (
+			DELETE FROM users_forum_permissions
+			WHERE user_id = $1 AND forum_id = $3
+			AND permission_id IN (SELECT id FROM permissions WHERE code = ANY($2))
+			RETURNING permission_id
+		)
+		SELECT code FROM permissions
+		WHERE id IN (SELECT permission_id FROM revoked)
+		ORDER BY code
+	`
+	return m.changeForUser(query, userID, event, userID, pq.Array([]string(codes)), forumID)
+}
+
+// Run a statement that changes a user's grants and returns the codes it
+// touched, recording the change in the same transaction
+func (m PermissionModel) changeForUser(query string, userID int64, event *AuditEvent, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	changed, err := scanCodes(rows)
+	if err != nil {
+		return err
+	}
+	if event.Details == nil {
+		event.Details = map[string]interface{}{}
+	}
+	event.Details["codes"] = changed
+	err = insertAuditEvent(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	m.Cache.deletePermissions(userID)
+	return nil
+}
+
+// Check whether a user was granted a code for one forum in particular
+func (m PermissionModel) IncludeForForum(userID, forumID int64, code string) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM users_forum_permissions
+			INNER JOIN permissions
+			ON users_forum_permissions.permission_id = permissions.id
+			WHERE users_forum_permissions.user_id = $1
+			AND users_forum_permissions.forum_id = $2
+			AND permissions.code = $3
+		)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var included bool
+	err := m.DB.QueryRowContext(ctx, query, userID, forumID, code).Scan(&included)
+	return included, err
+}
+
+// A ForumGrant is a code a user holds for a single forum
+type ForumGrant struct {
+	ForumID int64  `json:"forum_id"`
+	Code    string `json:"code"`
+}
+
+// Get the codes a user was granted for individual forums
+func (m PermissionModel) GetForumGrantsForUser(userID int64) ([]ForumGrant, error) {
+	query := `
+		SELECT users_forum_permissions.forum_id, permissions.code
+		FROM users_forum_permissions
+		INNER JOIN permissions
+		ON users_forum_permissions.permission_id = permissions.id
+		WHERE users_forum_permissions.user_id = $1
+		ORDER BY users_forum_permissions.forum_id, permissions.code
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []ForumGrant{}
+	for rows.Next() {
+		var grant ForumGrant
+		err := rows.Scan(&grant.ForumID, &grant.Code)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+func (m PermissionModel) queryCodes(ctx context.Context, query string, args ...interface{}) (Permissions, error) {
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanCodes(rows)
+}
+
+// The scanCodes() function reads a single column of codes and closes rows
+func scanCodes(rows *sql.Rows) (Permissions, error) {
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+// Check a list of codes against the ones that exist
+func ValidatePermissionCodes(v *validator.Validator, codes Permissions, known Permissions) {
+	v.Check(len(codes) > 0, "codes", "must contain at least one code")
+	v.Check(len(codes) <= 50, "codes", "must not contain more than 50 codes")
+	v.Check(validator.Unique(codes), "codes", "must not contain duplicate codes")
+	for _, code := range codes {
+		if !known.Include(code) {
+			v.AddError("codes", "must only contain known permission codes")
+			break
+		}
+	}
+}
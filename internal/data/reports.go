@@ -0,0 +1,289 @@
+// Filename: internal/data/reports.go
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"forum.kevin.net/internal/validator"
+	"github.com/lib/pq"
+)
+
+// What a report can be about
+var ReportReasons = []string{"spam", "harassment", "hate", "illegal", "off_topic", "other"}
+
+// The reason of reports raised by the content policy, users can't pick it
+const ReportReasonPolicy = "policy"
+
+// A report is open until a moderator resolves it with one of the others
+const (
+	ReportOpen      = "open"
+	ReportDismissed = "dismissed"
+	ReportHidden    = "hidden"
+	ReportDeleted   = "deleted"
+)
+
+// A Report flags a forum for moderators
+type Report struct {
+	ID             int64      `json:"id"`
+	CreatedAt      time.Time  `json:"createdat"`
+	ForumID        int64      `json:"forum_id"`
+	ReporterID     *int64     `json:"reporter_id"` // nil for the content policy
+	Reason         string     `json:"reason"`
+	Note           string     `json:"note,omitempty"`
+	Status         string     `json:"status"`
+	ResolvedBy     *int64     `json:"resolved_by,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	ResolutionNote string     `json:"resolution_note,omitempty"`
+}
+
+// A ReportGroup is a reported forum with its open reports
+type ReportGroup struct {
+	Forum           *Forum    `json:"forum"`
+	ReportCount     int       `json:"report_count"`
+	FirstReportedAt time.Time `json:"first_reported_at"`
+	Reports         []*Report `json:"reports"`
+}
+
+func ValidateReport(v *validator.Validator, report *Report) {
+	v.Check(report.Reason != "", "reason", "must be provided")
+	v.Check(report.Reason == "" || validator.In(report.Reason, ReportReasons...), "reason", "must be a known reason code")
+	v.Check(len(report.Note) <= 1000, "note", "must not be more than 1000 bytes long")
+}
+
+// Define the Report model
+type ReportModel struct {
+	DB *sql.DB
+}
+
+// Insert() files a report. A user's second open report on the same forum
+// replaces the first instead of adding to the queue, created tells which
+func (m ReportModel) Insert(report *Report) (created bool, err error) {
+	query := `
+		INSERT INTO reports (forum_id, reporter_id, reason, note)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (forum_id, reporter_id) WHERE status = 'open'
+		DO UPDATE SET reason = EXCLUDED.reason, note = EXCLUDED.note
+		RETURNING id, createdat, status, (xmax = 0)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{report.ForumID, report.ReporterID, report.Reason, report.Note}
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&report.ID, &report.CreatedAt, &report.Status, &created)
+	return created, err
+}
+
+// InsertForPolicy() queues a forum the content policy flagged. Held forums
+// are hidden in the same transaction until a moderator dismisses the report
+func (m ReportModel) InsertForPolicy(forum *Forum, note string, hold bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if hold {
+		query := `
+			UPDATE forums
+			SET hidden = true, version = version + 1
+			WHERE id = $1
+			RETURNING version
+		`
+		err = tx.QueryRowContext(ctx, query, forum.ID).Scan(&forum.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+		forum.Hidden = true
+	}
+	query := `
+		INSERT INTO reports (forum_id, reason, note)
+		VALUES ($1, $2, $3)
+	`
+	_, err = tx.ExecContext(ctx, query, forum.ID, ReportReasonPolicy, note)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get the moderation queue: reported forums with their open reports
+func (m ReportModel) GetOpenGroups(filters Filters) ([]*ReportGroup, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(),
+		forums.id, forums.createdat, forums.title, forums.category, forums.description,
+		forums.publisher, forums.releasedate, forums.user_id, forums.hidden, forums.version,
+		COUNT(reports.id) AS report_count, MIN(reports.createdat) AS first_reported_at
+		FROM reports
+		INNER JOIN forums
+		ON reports.forum_id = forums.id
+		WHERE reports.status = 'open'
+		GROUP BY forums.id
+		ORDER BY %s %s, forums.id ASC
+		LIMIT $1 OFFSET $2`, filters.sortColumn(), filters.sortOrder())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offSet())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	groups := []*ReportGroup{}
+	byForum := make(map[int64]*ReportGroup)
+	forumIDs := []int64{}
+	for rows.Next() {
+		var forum Forum
+		group := ReportGroup{Forum: &forum, Reports: []*Report{}}
+		err := rows.Scan(
+			&totalRecords,
+			&forum.ID,
+			&forum.CreatedAt,
+			&forum.Title,
+			&forum.Category,
+			&forum.Description,
+			&forum.Publisher,
+			&forum.ReleaseDate,
+			&forum.UserID,
+			&forum.Hidden,
+			&forum.Version,
+			&group.ReportCount,
+			&group.FirstReportedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		groups = append(groups, &group)
+		byForum[forum.ID] = &group
+		forumIDs = append(forumIDs, forum.ID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	// Fill in the reports of just the forums on this page
+	query = `
+		SELECT id, createdat, forum_id, reporter_id, reason, note, status
+		FROM reports
+		WHERE status = 'open' AND forum_id = ANY($1)
+		ORDER BY createdat, id
+	`
+	reportRows, err := m.DB.QueryContext(ctx, query, pq.Array(forumIDs))
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer reportRows.Close()
+	for reportRows.Next() {
+		var report Report
+		err := reportRows.Scan(
+			&report.ID,
+			&report.CreatedAt,
+			&report.ForumID,
+			&report.ReporterID,
+			&report.Reason,
+			&report.Note,
+			&report.Status,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		group := byForum[report.ForumID]
+		group.Reports = append(group.Reports, &report)
+	}
+	if err = reportRows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	return groups, metadata, nil
+}
+
+// Resolve() closes every open report on a forum and applies the outcome to
+// the forum in the same transaction: hidden forums are hidden, deleted ones
+// deleted. A warning to the author, if any, is recorded with it. It returns
+// the reporters so they can be told
+func (m ReportModel) Resolve(forumID, moderatorID int64, status, note string, warning *Warning) ([]*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var result sql.Result
+	switch status {
+	case ReportHidden:
+		result, err = tx.ExecContext(ctx, `UPDATE forums SET hidden = true, version = version + 1 WHERE id = $1`, forumID)
+	case ReportDeleted:
+		result, err = tx.ExecContext(ctx, `DELETE FROM forums WHERE id = $1`, forumID)
+	case ReportDismissed:
+		// Forums held by the content policy are released
+		_, err = tx.ExecContext(ctx, `UPDATE forums SET hidden = false, version = version + 1 WHERE id = $1 AND hidden`, forumID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result != nil {
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if rowsAffected == 0 {
+			return nil, ErrRecordNotFound
+		}
+	}
+
+	query := `
+		WITH resolved AS (
+			UPDATE reports
+			SET status = $2, resolved_by = $3, resolved_at = NOW(), resolution_note = $4
+			WHERE forum_id = $1 AND status = 'open'
+			RETURNING reporter_id
+		)
+		SELECT id, name, email
+		FROM users
+		WHERE id IN (SELECT reporter_id FROM resolved)
+	`
+	rows, err := tx.QueryContext(ctx, query, forumID, status, moderatorID, note)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reporters := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(&user.ID, &user.Name, &user.Email)
+		if err != nil {
+			return nil, err
+		}
+		reporters = append(reporters, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if warning != nil {
+		err = insertWarning(ctx, tx, warning)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return reporters, nil
+}
@@ -0,0 +1,136 @@
+// Filename: internal/data/roles.go
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Roles bundle permission codes, users get the union of their roles' codes
+// and any codes granted to them directly
+type RoleModel struct {
+	DB    *sql.DB
+	Cache *AuthCache
+}
+
+// Check that a role with this name exists
+func (m RoleModel) Exists(name string) (bool, error) {
+	query := `
+		SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(&exists)
+	return exists, err
+}
+
+// Get the names of the roles a user has
+func (m RoleModel) GetAllForUser(userID int64) ([]string, error) {
+	query := `
+		SELECT roles.name
+		FROM roles
+		INNER JOIN users_roles
+		ON users_roles.role_id = roles.id
+		WHERE users_roles.user_id = $1
+		ORDER BY roles.name
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		err := rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// Assign roles to a user, roles they already have are left alone
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	query := `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+		ON CONFLICT DO NOTHING
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	m.Cache.deletePermissions(userID)
+	return err
+}
+
+// Assign a role to a user and record it in the audit trail. Both happen or
+// neither does. The event's details say whether the user lacked the role
+func (m RoleModel) AssignToUser(userID int64, name string, event *AuditEvent) error {
+	query := `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = $2
+		ON CONFLICT DO NOTHING
+	`
+	return m.changeForUser(query, userID, name, event)
+}
+
+// Remove a role from a user and record it in the audit trail
+func (m RoleModel) RemoveFromUser(userID int64, name string, event *AuditEvent) error {
+	query := `
+		DELETE FROM users_roles
+		WHERE user_id = $1
+		AND role_id IN (SELECT id FROM roles WHERE name = $2)
+	`
+	return m.changeForUser(query, userID, name, event)
+}
+
+// The changeForUser() method runs a role change and its audit event in one
+// transaction, then drops the user's cached permissions
+func (m RoleModel) changeForUser(query string, userID int64, name string, event *AuditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, userID, name)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if event.Details == nil {
+		event.Details = map[string]interface{}{}
+	}
+	event.Details["role"] = name
+	event.Details["changed"] = rowsAffected > 0
+	err = insertAuditEvent(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	m.Cache.deletePermissions(userID)
+	return nil
+}
@@ -0,0 +1,144 @@
+// Filename: internal/data/serviceaccounts.go
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"forum.kevin.net/internal/validator"
+
+	"github.com/lib/pq"
+)
+
+// A service account is a user row that only ever authenticates with API keys
+type ServiceAccount struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"createdat"`
+	Name        string      `json:"name"`
+	OwnerID     int64       `json:"owner_id"`
+	Permissions Permissions `json:"permissions,omitempty"`
+}
+
+func ValidateServiceAccount(v *validator.Validator, account *ServiceAccount) {
+	v.Check(account.Name != "", "name", "must be provided")
+	v.Check(len(account.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(validator.Unique(account.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// lockedPasswordHash is not a bcrypt hash at all, so no password matches it
+var lockedPasswordHash = []byte("*")
+
+// Define the ServiceAccount model
+type ServiceAccountModel struct {
+	DB *sql.DB
+}
+
+// Create the user row behind a service account. It gets an address that can
+// never receive mail and a password hash no password can match, so it cannot
+// log in, and is granted its permissions in the same transaction
+func (m ServiceAccountModel) Insert(account *ServiceAccount) error {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	suffix := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	query := `
+		INSERT INTO users (name, email, password_hash, activated, service_account, owner_id)
+		VALUES ($1, $2, $3, true, true, $4)
+		RETURNING id, createdat
+	`
+	args := []interface{}{
+		account.Name,
+		"svc-" + suffix + "@service-accounts.invalid",
+		lockedPasswordHash,
+		account.OwnerID,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// The account and its permissions are created together or not at all
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&account.ID, &account.CreatedAt)
+	if err != nil {
+		return err
+	}
+	query = `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+	`
+	_, err = tx.ExecContext(ctx, query, account.ID, pq.Array([]string(account.Permissions)))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get a service account owned by the given user
+func (m ServiceAccountModel) GetForOwner(ownerID int64, id int64) (*ServiceAccount, error) {
+	query := `
+		SELECT id, createdat, name, owner_id
+		FROM users
+		WHERE id = $1 AND owner_id = $2 AND service_account = true
+	`
+	var account ServiceAccount
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id, ownerID).Scan(
+		&account.ID,
+		&account.CreatedAt,
+		&account.Name,
+		&account.OwnerID,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &account, nil
+}
+
+// Get every service account owned by the given user
+func (m ServiceAccountModel) GetAllForOwner(ownerID int64) ([]*ServiceAccount, error) {
+	query := `
+		SELECT id, createdat, name, owner_id
+		FROM users
+		WHERE owner_id = $1 AND service_account = true
+		ORDER BY id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*ServiceAccount{}
+	for rows.Next() {
+		var account ServiceAccount
+		err := rows.Scan(&account.ID, &account.CreatedAt, &account.Name, &account.OwnerID)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, &account)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
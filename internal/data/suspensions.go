@@ -0,0 +1,214 @@
+// Filename: internal/data/suspensions.go
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"forum.kevin.net/internal/validator"
+)
+
+// suspendedColumn is selected alongside a user to fill in User.Suspended
+const suspendedColumn = `
+	EXISTS (
+		SELECT 1 FROM suspensions
+		WHERE suspensions.user_id = users.id
+		AND suspensions.lifted_at IS NULL
+		AND (suspensions.expiry IS NULL OR suspensions.expiry > NOW())
+	)
+`
+
+// ownerSuspendedColumn is true for a service account whose owner is
+// suspended, so a suspended user can't carry on through their API keys
+const ownerSuspendedColumn = `
+	EXISTS (
+		SELECT 1 FROM suspensions
+		WHERE suspensions.user_id = users.owner_id
+		AND suspensions.lifted_at IS NULL
+		AND (suspensions.expiry IS NULL OR suspensions.expiry > NOW())
+	)
+`
+
+// A Suspension stops a user from signing in until it expires or is lifted.
+// A nil Expiry is a permanent ban
+type Suspension struct {
+	ID          int64      `json:"id"`
+	CreatedAt   time.Time  `json:"createdat"`
+	UserID      int64      `json:"user_id"`
+	ModeratorID *int64     `json:"moderator_id"`
+	Reason      string     `json:"reason"`
+	Expiry      *time.Time `json:"expiry"`
+	LiftedAt    *time.Time `json:"lifted_at,omitempty"`
+	LiftedBy    *int64     `json:"lifted_by,omitempty"`
+}
+
+func ValidateSuspension(v *validator.Validator, suspension *Suspension) {
+	v.Check(suspension.UserID > 0, "user_id", "must be provided")
+	v.Check(suspension.Reason != "", "reason", "must be provided")
+	v.Check(len(suspension.Reason) <= 500, "reason", "must not be more than 500 bytes long")
+	if suspension.Expiry != nil {
+		v.Check(suspension.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// Define the Suspension model
+type SuspensionModel struct {
+	DB    *sql.DB
+	Cache *AuthCache
+}
+
+// Insert() suspends a user and, in the same transaction, deletes every token
+// and authorization code they hold so nothing issued earlier keeps working.
+// Activation tokens are kept, they don't sign anyone in
+func (m SuspensionModel) Insert(suspension *Suspension) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO suspensions (user_id, moderator_id, reason, expiry)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, createdat
+	`
+	args := []interface{}{suspension.UserID, suspension.ModeratorID, suspension.Reason, suspension.Expiry}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&suspension.ID, &suspension.CreatedAt)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1 AND scope <> $2`, suspension.UserID, ScopeActivation)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM oauth_authorization_codes WHERE user_id = $1`, suspension.UserID)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	m.Cache.deleteSessionsForUser(suspension.UserID)
+	return nil
+}
+
+// Get the suspension that applies to a user now, the one lasting longest if
+// there are several
+func (m SuspensionModel) GetActiveForUser(userID int64) (*Suspension, error) {
+	query := `
+		SELECT id, createdat, user_id, moderator_id, reason, expiry
+		FROM suspensions
+		WHERE user_id = $1
+		AND lifted_at IS NULL
+		AND (expiry IS NULL OR expiry > $2)
+		ORDER BY expiry DESC NULLS FIRST
+		LIMIT 1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var suspension Suspension
+	err := m.DB.QueryRowContext(ctx, query, userID, time.Now()).Scan(
+		&suspension.ID,
+		&suspension.CreatedAt,
+		&suspension.UserID,
+		&suspension.ModeratorID,
+		&suspension.Reason,
+		&suspension.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &suspension, nil
+}
+
+// Get every suspension in force, newest first
+func (m SuspensionModel) GetAllActive(filters Filters) ([]*Suspension, Metadata, error) {
+	query := `
+		SELECT COUNT(*) OVER(), id, createdat, user_id, moderator_id, reason, expiry
+		FROM suspensions
+		WHERE lifted_at IS NULL
+		AND (expiry IS NULL OR expiry > $1)
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, time.Now(), filters.limit(), filters.offSet())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	suspensions := []*Suspension{}
+	for rows.Next() {
+		var suspension Suspension
+		err := rows.Scan(
+			&totalRecords,
+			&suspension.ID,
+			&suspension.CreatedAt,
+			&suspension.UserID,
+			&suspension.ModeratorID,
+			&suspension.Reason,
+			&suspension.Expiry,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		suspensions = append(suspensions, &suspension)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	return suspensions, metadata, nil
+}
+
+// Lift() ends a suspension early, it fails for ones already over
+func (m SuspensionModel) Lift(id, moderatorID int64) (*Suspension, error) {
+	query := `
+		UPDATE suspensions
+		SET lifted_at = NOW(), lifted_by = $2
+		WHERE id = $1
+		AND lifted_at IS NULL
+		AND (expiry IS NULL OR expiry > NOW())
+		RETURNING id, createdat, user_id, moderator_id, reason, expiry, lifted_at, lifted_by
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var suspension Suspension
+	err := m.DB.QueryRowContext(ctx, query, id, moderatorID).Scan(
+		&suspension.ID,
+		&suspension.CreatedAt,
+		&suspension.UserID,
+		&suspension.ModeratorID,
+		&suspension.Reason,
+		&suspension.Expiry,
+		&suspension.LiftedAt,
+		&suspension.LiftedBy,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	// Cached sessions remember the user as suspended
+	m.Cache.deleteSessionsForUser(suspension.UserID)
+	return &suspension, nil
+}
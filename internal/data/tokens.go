@@ -7,23 +7,42 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"forum.kevin.net/internal/validator"
+	"github.com/lib/pq"
 )
 
 // Token categories
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeTOTPChallenge  = "totp-challenge"
+	ScopeRefresh        = "refresh"
+)
+
+var (
+	ErrTokenReused = errors.New("refresh token reused")
 )
 
 type Token struct {
-	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	ID         int64     `json:"-"`
+	CreatedAt  time.Time `json:"-"`
+	Plaintext  string    `json:"token"`
+	Hash       []byte    `json:"-"`
+	UserID     int64     `json:"-"`
+	Expiry     time.Time `json:"expiry"`
+	Scope      string    `json:"-"`
+	LastUsedAt time.Time `json:"-"`
+	UserAgent  string    `json:"-"`
+	IP         string    `json:"-"`
+	Family     string    `json:"-"`
+	Used       bool      `json:"-"`
+	// Permissions restricts what the token may do, nil means everything the
+	// user holds. OAuth tokens also record the client they were issued to
+	Permissions Permissions `json:"-"`
+	ClientID    *int64      `json:"-"`
 }
 
 // The generateToken() function returns a token
@@ -42,11 +61,16 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	}
 	// Encode the byte slice to a base-32 encoded string
 	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	token.Hash = HashTokenPlaintext(token.Plaintext)
 	return token, nil
 }
 
+// HashTokenPlaintext() returns the SHA-256 hash we store instead of the token
+func HashTokenPlaintext(tokenPlaintext string) []byte {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return hash[:]
+}
+
 // Check that the plaintext token is 26 bytes long
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be 26 bytes long")
@@ -54,7 +78,8 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 
 // Define the Token model
 type TokenModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *AuthCache
 }
 
 // Create and insert a Token into the tokens table
@@ -68,23 +93,254 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 
 }
 
+// Create an access and refresh token pair that records the client it was
+// issued to. An empty family starts a new one
+func (m TokenModel) NewSessionPair(userID int64, family string, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	session := &Token{UserID: userID, Family: family, UserAgent: userAgent, IP: ip}
+	access, refresh, err := newSessionPair(ctx, tx, session, accessTTL, refreshTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// Create a token pair for an OAuth client acting on behalf of a user
+func (m TokenModel) NewOAuthSessionPair(userID int64, clientID int64, permissions Permissions, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	session := &Token{UserID: userID, UserAgent: userAgent, IP: ip, Permissions: permissions, ClientID: &clientID}
+	access, refresh, err := newSessionPair(ctx, tx, session, accessTTL, refreshTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// newSessionPair() inserts an access and refresh token that copy the user,
+// family, client details and restrictions of session
+func newSessionPair(ctx context.Context, tx *sql.Tx, session *Token, accessTTL, refreshTTL time.Duration) (*Token, *Token, error) {
+	family := session.Family
+	if family == "" {
+		randomBytes := make([]byte, 16)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		family = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	}
+	access, err := generateToken(session.UserID, accessTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh, err := generateToken(session.UserID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, token := range []*Token{access, refresh} {
+		token.Family = family
+		token.UserAgent = session.UserAgent
+		token.IP = session.IP
+		token.Permissions = session.Permissions
+		token.ClientID = session.ClientID
+		err = insertToken(ctx, tx, token)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return access, refresh, nil
+}
+
 // Insert token entry
 func (m TokenModel) Insert(token *Token) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertToken(ctx, m.DB, token)
+}
+
+// The queryRower interface is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func insertToken(ctx context.Context, db queryRower, token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip, family, permissions, oauth_client_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, createdat, last_used_at
 	`
 	args := []interface{}{
 		token.Hash,
 		token.UserID,
 		token.Expiry,
 		token.Scope,
+		token.UserAgent,
+		token.IP,
+		token.Family,
+		pq.Array([]string(token.Permissions)),
+		token.ClientID,
 	}
+	return db.QueryRowContext(ctx, query, args...).Scan(&token.ID, &token.CreatedAt, &token.LastUsedAt)
+}
+
+// Rotate() exchanges an unused refresh token for a new pair in the same family.
+// Presenting a refresh token that was already used revokes the whole family.
+// The token must have been issued to clientID, nil for our own clients
+func (m TokenModel) Rotate(refreshPlaintext string, clientID *int64, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
-	return err
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the row so two concurrent refreshes cannot both succeed
+	query := `
+		SELECT id, user_id, expiry, family, used, permissions, oauth_client_id
+		FROM tokens
+		WHERE hash = $1 AND scope = $2
+		AND oauth_client_id IS NOT DISTINCT FROM $3
+		FOR UPDATE
+	`
+	var token Token
+	err = tx.QueryRowContext(ctx, query, HashTokenPlaintext(refreshPlaintext), ScopeRefresh, clientID).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Expiry,
+		&token.Family,
+		&token.Used,
+		pq.Array((*[]string)(&token.Permissions)),
+		&token.ClientID,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	// A reused token means it was stolen, so revoke every token in the family
+	if token.Used {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, token.Family)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return nil, nil, err
+		}
+		m.Cache.deleteSessionsForUser(token.UserID)
+		return nil, nil, ErrTokenReused
+	}
+	if time.Now().After(token.Expiry) {
+		return nil, nil, ErrRecordNotFound
+	}
+	// Retire the old pair, the used refresh token is kept to detect reuse
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used = true WHERE id = $1`, token.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1 AND scope = $2`, token.Family, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	token.UserAgent = userAgent
+	token.IP = ip
+	access, refresh, err := newSessionPair(ctx, tx, &token, accessTTL, refreshTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	m.Cache.deleteSessionsForUser(token.UserID)
+	return access, refresh, nil
+}
+
+// Get the unexpired tokens of a scope for a user, most recently used first
+func (m TokenModel) GetAllForUser(scope string, userID int64) ([]*Token, error) {
+	query := `
+		SELECT id, createdat, user_id, expiry, scope, last_used_at, user_agent, ip
+		FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND expiry > $3
+		ORDER BY last_used_at DESC, id DESC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, scope, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+	for rows.Next() {
+		var token Token
+		err := rows.Scan(
+			&token.ID,
+			&token.CreatedAt,
+			&token.UserID,
+			&token.Expiry,
+			&token.Scope,
+			&token.LastUsedAt,
+			&token.UserAgent,
+			&token.IP,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Record that a token was just used
+func (m TokenModel) Touch(token *Token) error {
+	query := `
+		UPDATE tokens
+		SET last_used_at = $2
+		WHERE id = $1
+	`
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, token.ID, now)
+	if err != nil {
+		return err
+	}
+	m.Cache.touchSession(token.Hash, now)
+	return nil
 }
 
 // Delete token
@@ -96,6 +352,109 @@ func (m TokenModel) DeleteAllForUsers(scope string, userID int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	m.Cache.deleteSessionsForUser(userID)
 
 	return err
 }
+
+// Count a failed attempt against a token, deleting it once it has had
+// maxAttempts of them so it can't be guessed against any longer
+func (m TokenModel) CountFailedAttempt(scope, tokenPlaintext string, maxAttempts int) error {
+	query := `
+		UPDATE tokens SET attempts = attempts + 1
+		WHERE hash = $1 AND scope = $2
+		RETURNING attempts
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hash := HashTokenPlaintext(tokenPlaintext)
+	var attempts int
+	err = tx.QueryRowContext(ctx, query, hash, scope).Scan(&attempts)
+	if err != nil {
+		switch {
+		// Already gone, so there is nothing left to guess against
+		case errors.Is(err, sql.ErrNoRows):
+			return nil
+		default:
+			return err
+		}
+	}
+	if attempts >= maxAttempts {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE hash = $1 AND scope = $2`, hash, scope)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Delete one of a user's authentication tokens along with the rest of its family
+func (m TokenModel) DeleteSessionForUser(userID int64, id int64) error {
+	query := `
+		WITH target AS (
+			SELECT id, family FROM tokens
+			WHERE user_id = $1 AND id = $2 AND scope = $3
+		)
+		DELETE FROM tokens
+		WHERE user_id = $1
+		AND (id IN (SELECT id FROM target) OR family IN (SELECT family FROM target WHERE family <> ''))
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, id, ScopeAuthentication)
+	if err != nil {
+		return err
+	}
+	m.Cache.deleteSessionsForUser(userID)
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Revoke the family of a token that was issued to an OAuth client
+func (m TokenModel) DeleteFamilyForClient(tokenPlaintext string, clientID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE oauth_client_id = $2
+		AND family IN (
+			SELECT family FROM tokens
+			WHERE hash = $1 AND oauth_client_id = $2 AND family <> ''
+		)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, HashTokenPlaintext(tokenPlaintext), clientID)
+	m.Cache.deleteSessionsForClient(clientID)
+	return err
+}
+
+// Delete up to batchSize expired tokens and report how many went
+func (m TokenModel) DeleteExpired(batchSize int) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE hash IN (
+			SELECT hash FROM tokens
+			WHERE expiry < $1
+			LIMIT $2
+		)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, time.Now(), batchSize)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
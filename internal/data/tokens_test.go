@@ -0,0 +1,85 @@
+// Filename: internal/data/tokens_test.go
+package data
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// openTestDB() connects to a migrated test database, skipping the test when
+// none is given
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TESTFORUM_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TESTFORUM_TEST_DB_DSN not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// insertTestUser() adds an activated user holding roles that is deleted
+// after the test
+func insertTestUser(t *testing.T, models Models, roles ...string) *User {
+	t.Helper()
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		t.Fatal(err)
+	}
+	user := &User{
+		Name:      "Data Test",
+		Email:     "data-" + hex.EncodeToString(suffix) + "@example.com",
+		Activated: true,
+	}
+	if err := user.Password.Set("pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Users.Insert(user, roles...); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { models.Users.DB.Exec(`DELETE FROM users WHERE id = $1`, user.ID) })
+	return user
+}
+
+func TestCountFailedAttemptDeletesChallenge(t *testing.T) {
+	models := NewModels(openTestDB(t), nil)
+	user := insertTestUser(t, models)
+	token, err := models.Tokens.New(user.ID, 5*time.Minute, ScopeTOTPChallenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const maxAttempts = 5
+	for i := 1; i <= maxAttempts; i++ {
+		err := models.Tokens.CountFailedAttempt(ScopeTOTPChallenge, token.Plaintext, maxAttempts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = models.Users.GetForToken(ScopeTOTPChallenge, token.Plaintext)
+		switch {
+		case i < maxAttempts && err != nil:
+			t.Fatalf("after %d failed attempts: got %v, want the challenge still valid", i, err)
+		case i == maxAttempts && !errors.Is(err, ErrRecordNotFound):
+			t.Fatalf("after %d failed attempts: got %v, want %v", i, err, ErrRecordNotFound)
+		}
+	}
+	// Counting against a deleted challenge is not an error
+	err = models.Tokens.CountFailedAttempt(ScopeTOTPChallenge, token.Plaintext, maxAttempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"forum.kevin.net/internal/validator"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -20,13 +22,15 @@ var (
 )
 
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"createdat"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID             int64     `json:"id"`
+	CreatedAt      time.Time `json:"createdat"`
+	Name           string    `json:"name"`
+	Email          string    `json:"email"`
+	Password       password  `json:"-"`
+	Activated      bool      `json:"activated"`
+	Suspended      bool      `json:"-"` // only filled in when authenticating
+	ServiceAccount bool      `json:"-"` // only ever authenticates with API keys
+	Version        int       `json:"-"`
 }
 
 // Check if the user is anonymous
@@ -96,11 +100,12 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 // Create our user model
 type UserModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *AuthCache
 }
 
-// Create a new user
-func (m UserModel) Insert(user *User) error {
+// Create a new user holding the named roles
+func (m UserModel) Insert(user *User, roles ...string) error {
 	query := `
 	INSERT INTO users (name, email, password_hash, activated)
 	VALUES($1, $2, $3, $4)
@@ -115,7 +120,15 @@ func (m UserModel) Insert(user *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	// The user and their roles are created together, so a failure never
+	// leaves an account behind without its roles
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -124,13 +137,23 @@ func (m UserModel) Insert(user *User) error {
 			return err
 		}
 	}
-	return nil
+	if len(roles) > 0 {
+		query = `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+		`
+		_, err = tx.ExecContext(ctx, query, user.ID, pq.Array(roles))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 // Get user based on their email
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-SELECT id, createdat, name, email, password_hash, activated, version
+SELECT id, createdat, name, email, password_hash, activated, version, service_account
 FROM users
 WHERE email= $1
 `
@@ -146,6 +169,42 @@ WHERE email= $1
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.ServiceAccount,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// Get user based on their id
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, createdat, name, email, password_hash, activated, version, service_account
+		FROM users
+		WHERE id = $1
+	`
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.ServiceAccount,
 	)
 	if err != nil {
 		switch {
@@ -158,6 +217,71 @@ WHERE email= $1
 	return &user, nil
 }
 
+// Search users whose email address contains email, an empty string matches
+// everyone
+func (m UserModel) Search(email string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), id, createdat, name, email, activated
+		FROM users
+		WHERE strpos(lower(email), lower($1)) > 0
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortOrder())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, email, filters.limit(), filters.offSet())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	return users, metadata, nil
+}
+
+// Delete up to batchSize accounts that were never activated and were created
+// before cutoff, freeing their email addresses
+func (m UserModel) DeleteUnactivatedBefore(cutoff time.Time, batchSize int) (int64, error) {
+	query := `
+		DELETE FROM users
+		WHERE id IN (
+			SELECT id FROM users
+			WHERE activated = false AND createdat < $1
+			LIMIT $2
+		)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, cutoff, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if n > 0 {
+		m.Cache.purgeSessions()
+	}
+	return n, err
+}
+
 // The client can update their info
 func (m UserModel) Update(user *User) error {
 	query := `
@@ -178,7 +302,8 @@ func (m UserModel) Update(user *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
-
+	// Cached sessions hold a copy of the user
+	m.Cache.deleteSessionsForUser(user.ID)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -196,7 +321,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	//setup query
 	query := `
 		SELECT users.id, users.createdat, users.name, users.email,
-		users.password_hash, users.activated, users.version
+		users.password_hash, users.activated, users.version, users.service_account
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
@@ -217,6 +342,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.ServiceAccount,
 	)
 	if err != nil {
 		switch {
@@ -228,3 +354,61 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	}
 	return &user, nil
 }
+
+// Get the user for an authentication token together with the token's session details
+func (m UserModel) GetForAuthenticationToken(tokenPlaintext string) (*User, *Token, error) {
+	query := `
+		SELECT users.id, users.createdat, users.name, users.email,
+		users.password_hash, users.activated, users.version, users.service_account, ` + suspendedColumn + `,
+		tokens.id, tokens.createdat, tokens.expiry, tokens.last_used_at,
+		tokens.permissions, tokens.oauth_client_id
+		FROM users
+		INNER JOIN tokens
+		ON users.id = tokens.user_id
+		WHERE tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3
+	`
+	token := Token{
+		Plaintext: tokenPlaintext,
+		Hash:      HashTokenPlaintext(tokenPlaintext),
+		Scope:     ScopeAuthentication,
+	}
+	cachedUser, session, generation, found := m.Cache.getSession(token.Hash)
+	if found {
+		return cachedUser, session, nil
+	}
+	args := []interface{}{token.Hash, token.Scope, time.Now()}
+	var user User
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.ServiceAccount,
+		&user.Suspended,
+		&token.ID,
+		&token.CreatedAt,
+		&token.Expiry,
+		&token.LastUsedAt,
+		pq.Array((*[]string)(&token.Permissions)),
+		&token.ClientID,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	token.UserID = user.ID
+	m.Cache.setSession(&user, &token, generation)
+	return &user, &token, nil
+}
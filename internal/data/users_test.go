@@ -0,0 +1,36 @@
+// Filename: internal/data/users_test.go
+package data
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInsertAssignsRoles(t *testing.T) {
+	models := NewModels(openTestDB(t), nil)
+	user := insertTestUser(t, models, "member")
+
+	roles, err := models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 1 || roles[0] != "member" {
+		t.Errorf("roles = %v, want [member]", roles)
+	}
+
+	// A duplicate email rolls back without touching the first user's roles
+	duplicate := &User{Name: "Data Test", Email: user.Email}
+	if err := duplicate.Password.Set("pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Users.Insert(duplicate, "admin"); !errors.Is(err, ErrDuplicateEmail) {
+		t.Fatalf("Insert() error = %v, want ErrDuplicateEmail", err)
+	}
+	roles, err = models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 1 {
+		t.Errorf("roles = %v after a failed insert", roles)
+	}
+}
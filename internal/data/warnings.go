@@ -0,0 +1,47 @@
+// Filename: internal/data/warnings.go
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"forum.kevin.net/internal/validator"
+)
+
+// A Warning is a moderator's note to a user about their content
+type Warning struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"createdat"`
+	UserID      int64     `json:"user_id"`
+	ModeratorID *int64    `json:"moderator_id"`
+	ForumID     *int64    `json:"forum_id,omitempty"`
+	Message     string    `json:"message"`
+}
+
+func ValidateWarning(v *validator.Validator, warning *Warning) {
+	v.Check(warning.Message != "", "warning", "must be provided")
+	v.Check(len(warning.Message) <= 1000, "warning", "must not be more than 1000 bytes long")
+}
+
+// Define the Warning model
+type WarningModel struct {
+	DB *sql.DB
+}
+
+func (m WarningModel) Insert(warning *Warning) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertWarning(ctx, m.DB, warning)
+}
+
+func insertWarning(ctx context.Context, db queryRower, warning *Warning) error {
+	query := `
+		INSERT INTO warnings (user_id, moderator_id, forum_id, message)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, createdat
+	`
+	args := []interface{}{warning.UserID, warning.ModeratorID, warning.ForumID, warning.Message}
+	return db.QueryRowContext(ctx, query, args...).Scan(&warning.ID, &warning.CreatedAt)
+}
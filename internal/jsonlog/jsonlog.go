@@ -39,7 +39,8 @@ func (l Level) String() string {
 type Logger struct {
 	out      io.Writer
 	minLevel Level
-	mu       sync.Mutex
+	mu       *sync.Mutex       // shared with child loggers so lines never interleave
+	fields   map[string]string // added to the properties of every entry
 }
 
 // The New() function creates a new instance of Logger
@@ -47,6 +48,25 @@ func New(out io.Writer, minLevel Level) *Logger {
 	return &Logger{
 		out:      out,
 		minLevel: minLevel,
+		mu:       &sync.Mutex{},
+	}
+}
+
+// With() returns a child logger that adds fields to every entry it writes,
+// on top of any the parent adds. Properties passed to a call win over them
+func (l *Logger) With(fields map[string]string) *Logger {
+	merged := make(map[string]string, len(l.fields)+len(fields))
+	for key, value := range l.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &Logger{
+		out:      l.out,
+		minLevel: l.minLevel,
+		mu:       l.mu,
+		fields:   merged,
 	}
 }
 
@@ -69,6 +89,17 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 	if level < l.minLevel {
 		return 0, nil
 	}
+	// Add the logger's own fields without changing the caller's map
+	if len(l.fields) > 0 {
+		merged := make(map[string]string, len(l.fields)+len(properties))
+		for key, value := range l.fields {
+			merged[key] = value
+		}
+		for key, value := range properties {
+			merged[key] = value
+		}
+		properties = merged
+	}
 	// Create a struct for holding the log entry data
 	data := struct {
 		Level      string            `json:"level"`
@@ -0,0 +1,143 @@
+// Filename: internal/jwt/jwt.go
+package jwt
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed    = errors.New("jwt: malformed token")
+	ErrUnknownKey   = errors.New("jwt: unknown key id")
+	ErrBadSignature = errors.New("jwt: invalid signature")
+	ErrExpired      = errors.New("jwt: token has expired")
+	ErrNoSigningKey = errors.New("jwt: no signing key configured")
+)
+
+var encoding = base64.RawURLEncoding
+
+// The header of every token we issue
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Claims carried by an access token
+type Claims struct {
+	ID          string   `json:"jti"`
+	Subject     int64    `json:"sub"`
+	Email       string   `json:"email"`
+	Activated   bool     `json:"act"`
+	Permissions []string `json:"perms"`
+	ClientID    int64    `json:"cid,omitempty"`
+	IssuedAt    int64    `json:"iat"`
+	Expiry      int64    `json:"exp"`
+}
+
+// A KeySet signs with its active key and verifies with any key it holds, so
+// old keys can stay around until the tokens they signed have expired
+type KeySet struct {
+	activeID string
+	keys     map[string]ed25519.PrivateKey
+}
+
+// ParseKeySet() reads keys in the form "kid=base64url(seed) kid=base64url(seed)".
+// The first key is the one used for signing
+func ParseKeySet(spec string) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]ed25519.PrivateKey)}
+	for _, field := range strings.Fields(spec) {
+		kid, encoded, found := strings.Cut(field, "=")
+		if !found || kid == "" {
+			return nil, fmt.Errorf("jwt: key %q must be in the form kid=seed", field)
+		}
+		seed, err := encoding.DecodeString(encoded)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("jwt: key %q must be a base64url encoded %d-byte seed", kid, ed25519.SeedSize)
+		}
+		if _, exists := ks.keys[kid]; exists {
+			return nil, fmt.Errorf("jwt: duplicate key id %q", kid)
+		}
+		ks.keys[kid] = ed25519.NewKeyFromSeed(seed)
+		if ks.activeID == "" {
+			ks.activeID = kid
+		}
+	}
+	return ks, nil
+}
+
+// Len() returns the number of keys in the set
+func (ks *KeySet) Len() int {
+	return len(ks.keys)
+}
+
+// Sign() encodes and signs the claims with the active key
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	key, ok := ks.keys[ks.activeID]
+	if !ok {
+		return "", ErrNoSigningKey
+	}
+	h, err := json.Marshal(header{Algorithm: "EdDSA", Type: "JWT", KeyID: ks.activeID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+	signature := ed25519.Sign(key, []byte(signingInput))
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
+
+// Verify() checks the signature and expiry of a token and returns its claims
+func (ks *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	rawHeader, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var h header
+	err = json.Unmarshal(rawHeader, &h)
+	if err != nil || h.Algorithm != "EdDSA" {
+		return nil, ErrMalformed
+	}
+	key, ok := ks.keys[h.KeyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !ed25519.Verify(key.Public().(ed25519.PublicKey), []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrBadSignature
+	}
+	rawClaims, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var claims Claims
+	err = json.Unmarshal(rawClaims, &claims)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if now.Unix() >= claims.Expiry {
+		return nil, ErrExpired
+	}
+	return &claims, nil
+}
+
+// Looks() reports whether a bearer token is shaped like a JWT rather than
+// one of our opaque database tokens
+func Looks(token string) bool {
+	return strings.Count(token, ".") == 2
+}
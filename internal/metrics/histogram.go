@@ -0,0 +1,82 @@
+// Filename: internal/metrics/histogram.go
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// DefaultBuckets suit request latencies measured in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// A Histogram counts observations into buckets by upper bound
+type Histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	counts  []uint64 // per bucket, not yet cumulative
+	sum     float64
+	samples uint64
+}
+
+// Observe() records one value
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.samples++
+}
+
+// HistogramVec is a histogram split by labels
+type HistogramVec struct {
+	vec[Histogram]
+	bounds []float64
+}
+
+// NewHistogramVec() registers a histogram with the given buckets and label names
+func (reg *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+	hv := &HistogramVec{bounds: bounds}
+	hv.vec = vec[Histogram]{
+		name:     name,
+		help:     help,
+		kind:     "histogram",
+		labels:   labels,
+		children: make(map[string]*child[Histogram]),
+		create: func() *Histogram {
+			return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+		},
+	}
+	reg.add(hv)
+	return hv
+}
+
+// With() returns the histogram for a set of label values, in label order
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return hv.with(values)
+}
+
+func (hv *HistogramVec) write(w *bufio.Writer) {
+	writeHeader(w, hv.name, hv.help, hv.kind)
+	for _, c := range hv.sorted() {
+		h := c.metric
+		h.mu.Lock()
+		var cumulative uint64
+		for i, bound := range hv.bounds {
+			cumulative += h.counts[i]
+			le := `le="` + formatFloat(bound) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, labelSet(hv.labels, c.values, le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, labelSet(hv.labels, c.values, `le="`+formatFloat(math.Inf(1))+`"`), h.samples)
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.name, labelSet(hv.labels, c.values, ""), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, labelSet(hv.labels, c.values, ""), h.samples)
+		h.mu.Unlock()
+	}
+}
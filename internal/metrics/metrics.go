@@ -0,0 +1,265 @@
+// Filename: internal/metrics/metrics.go
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A metric writes itself in the Prometheus text exposition format
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// A Registry holds the metrics served at one endpoint
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// The NewRegistry() function creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (reg *Registry) add(m metric) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.metrics = append(reg.metrics, m)
+}
+
+// Handler() serves every metric in the registry, in the order they were created
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reg.mu.Lock()
+		metrics := append([]metric(nil), reg.metrics...)
+		reg.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buf := bufio.NewWriter(w)
+		for _, m := range metrics {
+			m.write(buf)
+		}
+		buf.Flush()
+	})
+}
+
+// writeHeader() writes the HELP and TYPE lines of a metric
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// formatFloat() writes numbers the way Prometheus expects them
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelSet() formats label pairs as {name="value",...}, extra is appended
+// as is for the le label of histogram buckets
+func labelSet(names, values []string, extra string) string {
+	if len(names) == 0 && extra == "" {
+		return ""
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escape.Replace(values[i])+`"`)
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// A Counter only goes up
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+// A Gauge goes up and down
+type Gauge struct {
+	value atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.value.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.Add(-1)
+}
+
+// A vec holds one child metric per combination of label values
+type vec[T any] struct {
+	name     string
+	help     string
+	kind     string
+	labels   []string
+	mu       sync.RWMutex
+	children map[string]*child[T]
+	create   func() *T
+}
+
+type child[T any] struct {
+	values []string
+	metric *T
+}
+
+// with() returns the child for some label values, creating it on first use
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	c, found := v.children[key]
+	v.mu.RUnlock()
+	if found {
+		return c.metric
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, found := v.children[key]; found {
+		return c.metric
+	}
+	c = &child[T]{values: append([]string(nil), values...), metric: v.create()}
+	v.children[key] = c
+	return c.metric
+}
+
+// sorted() returns the children ordered by label values so output is stable
+func (v *vec[T]) sorted() []*child[T] {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]*child[T], len(keys))
+	for i, key := range keys {
+		children[i] = v.children[key]
+	}
+	return children
+}
+
+// CounterVec is a counter split by labels
+type CounterVec struct {
+	vec[Counter]
+}
+
+// NewCounter() registers a counter without labels
+func (reg *Registry) NewCounter(name, help string) *Counter {
+	return reg.NewCounterVec(name, help).With()
+}
+
+// NewCounterVec() registers a counter with the given label names
+func (reg *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{vec[Counter]{
+		name:     name,
+		help:     help,
+		kind:     "counter",
+		labels:   labels,
+		children: make(map[string]*child[Counter]),
+		create:   func() *Counter { return &Counter{} },
+	}}
+	reg.add(cv)
+	return cv
+}
+
+// With() returns the counter for a set of label values, in label order
+func (cv *CounterVec) With(values ...string) *Counter {
+	return cv.with(values)
+}
+
+func (cv *CounterVec) write(w *bufio.Writer) {
+	writeHeader(w, cv.name, cv.help, cv.kind)
+	for _, c := range cv.sorted() {
+		fmt.Fprintf(w, "%s%s %d\n", cv.name, labelSet(cv.labels, c.values, ""), c.metric.value.Load())
+	}
+}
+
+// GaugeVec is a gauge split by labels
+type GaugeVec struct {
+	vec[Gauge]
+}
+
+// NewGauge() registers a gauge without labels
+func (reg *Registry) NewGauge(name, help string) *Gauge {
+	return reg.NewGaugeVec(name, help).With()
+}
+
+// NewGaugeVec() registers a gauge with the given label names
+func (reg *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	gv := &GaugeVec{vec[Gauge]{
+		name:     name,
+		help:     help,
+		kind:     "gauge",
+		labels:   labels,
+		children: make(map[string]*child[Gauge]),
+		create:   func() *Gauge { return &Gauge{} },
+	}}
+	reg.add(gv)
+	return gv
+}
+
+// With() returns the gauge for a set of label values, in label order
+func (gv *GaugeVec) With(values ...string) *Gauge {
+	return gv.with(values)
+}
+
+func (gv *GaugeVec) write(w *bufio.Writer) {
+	writeHeader(w, gv.name, gv.help, gv.kind)
+	for _, c := range gv.sorted() {
+		fmt.Fprintf(w, "%s%s %d\n", gv.name, labelSet(gv.labels, c.values, ""), c.metric.value.Load())
+	}
+}
+
+// A funcMetric reads its value when it is scraped, for numbers that are
+// kept somewhere else such as connection pool statistics
+type funcMetric struct {
+	name  string
+	help  string
+	kind  string
+	value func() float64
+}
+
+// NewGaugeFunc() registers a gauge whose value comes from fn
+func (reg *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	reg.add(&funcMetric{name: name, help: help, kind: "gauge", value: fn})
+}
+
+// NewCounterFunc() registers a counter whose value comes from fn, which
+// must never go down
+func (reg *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	reg.add(&funcMetric{name: name, help: help, kind: "counter", value: fn})
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	writeHeader(w, f.name, f.help, f.kind)
+	fmt.Fprintf(w, "%s %s\n", f.name, formatFloat(f.value()))
+}
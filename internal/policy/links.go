@@ -0,0 +1,68 @@
+// Filename: internal/policy/links.go
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// A link is anything starting with a scheme or www.
+	linkRX = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"']+`)
+	// A host is a dotted name, with or without a scheme in front of it
+	hostRX = regexp.MustCompile(`(?i)(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}\b`)
+)
+
+// LinkCount rejects text with more than Max links
+type LinkCount struct {
+	Max int
+}
+
+func (c LinkCount) Name() string {
+	return "links"
+}
+
+func (c LinkCount) Check(text string) string {
+	if n := len(linkRX.FindAllString(text, -1)); n > c.Max {
+		return fmt.Sprintf("contains more than %d links", c.Max)
+	}
+	return ""
+}
+
+// DomainBlocklist rejects text mentioning a blocked domain or any of its
+// subdomains, whether or not it is written as a link
+type DomainBlocklist struct {
+	domains []string
+}
+
+// The NewDomainBlocklist() function creates a blocklist from domain names
+func NewDomainBlocklist(domains []string) *DomainBlocklist {
+	l := &DomainBlocklist{}
+	for _, domain := range domains {
+		domain = strings.Trim(strings.ToLower(domain), ". ")
+		if domain != "" {
+			l.domains = append(l.domains, domain)
+		}
+	}
+	return l
+}
+
+func (l *DomainBlocklist) Name() string {
+	return "domains"
+}
+
+func (l *DomainBlocklist) Check(text string) string {
+	if len(l.domains) == 0 {
+		return ""
+	}
+	for _, host := range hostRX.FindAllString(text, -1) {
+		host = strings.ToLower(host)
+		for _, domain := range l.domains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return "links to a blocked domain"
+			}
+		}
+	}
+	return ""
+}
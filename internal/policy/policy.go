@@ -0,0 +1,113 @@
+// Filename: internal/policy/policy.go
+package policy
+
+import "sort"
+
+// An Action is what happens to content that breaks a rule. Higher actions
+// win when several rules match
+type Action int
+
+const (
+	Allow  Action = iota
+	Flag          // store it and queue it for a moderator
+	Hold          // store it hidden until a moderator approves it
+	Reject        // refuse it with a validation error
+)
+
+func (a Action) String() string {
+	switch a {
+	case Flag:
+		return "flag"
+	case Hold:
+		return "hold"
+	case Reject:
+		return "reject"
+	default:
+		return "allow"
+	}
+}
+
+// ParseAction() reads an action from configuration
+func ParseAction(s string) (Action, bool) {
+	for _, a := range []Action{Allow, Flag, Hold, Reject} {
+		if a.String() == s {
+			return a, true
+		}
+	}
+	return Allow, false
+}
+
+// A Checker looks at one piece of text. It returns a short reason when the
+// text breaks its rule and "" when it doesn't
+type Checker interface {
+	Name() string
+	Check(text string) string
+}
+
+// A Rule ties a checker to what happens when it matches
+type Rule struct {
+	Checker Checker
+	Action  Action
+}
+
+// A Violation is one rule that matched one field
+type Violation struct {
+	Field  string `json:"field"`
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+	Action Action `json:"-"`
+}
+
+// The Result of evaluating content: the strongest action and every violation
+type Result struct {
+	Action     Action
+	Violations []Violation
+}
+
+// Policy is an ordered set of rules. The zero value allows everything
+type Policy struct {
+	rules []Rule
+}
+
+// The New() function creates a policy, rules with the Allow action are dropped
+func New(rules ...Rule) *Policy {
+	p := &Policy{}
+	for _, rule := range rules {
+		if rule.Checker != nil && rule.Action != Allow {
+			p.rules = append(p.rules, rule)
+		}
+	}
+	return p
+}
+
+// Evaluate() runs every rule on every field. Fields are checked in name order
+// so the result does not depend on map order
+func (p *Policy) Evaluate(fields map[string]string) Result {
+	var result Result
+	if p == nil {
+		return result
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, rule := range p.rules {
+			reason := rule.Checker.Check(fields[name])
+			if reason == "" {
+				continue
+			}
+			result.Violations = append(result.Violations, Violation{
+				Field:  name,
+				Rule:   rule.Checker.Name(),
+				Reason: reason,
+				Action: rule.Action,
+			})
+			if rule.Action > result.Action {
+				result.Action = rule.Action
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,198 @@
+// Filename: internal/policy/words.go
+package policy
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Characters people swap in for letters to get past filters
+var leet = map[rune]rune{
+	'0': 'o',
+	'1': 'i',
+	'3': 'e',
+	'4': 'a',
+	'5': 's',
+	'7': 't',
+	'8': 'b',
+	'@': 'a',
+	'$': 's',
+	'!': 'i',
+	'|': 'l',
+	'+': 't',
+}
+
+// WordList rejects text containing any of a list of words, whole words only
+// so that innocent words containing a blocked one still pass. Entries of
+// several words only match those words in a row
+type WordList struct {
+	words   map[string]bool
+	phrases [][]string
+}
+
+// The NewWordList() function normalises the words the same way text is
+func NewWordList(words []string) *WordList {
+	l := &WordList{words: make(map[string]bool)}
+	for _, word := range words {
+		switch entry := tokens(word); len(entry) {
+		case 0:
+		case 1:
+			l.words[entry[0]] = true
+		default:
+			l.phrases = append(l.phrases, entry)
+		}
+	}
+	return l
+}
+
+// LoadWordList() reads one word per line, skipping blank lines and # comments
+func LoadWordList(path string) (*WordList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewWordList(words), nil
+}
+
+func (l *WordList) Name() string {
+	return "words"
+}
+
+func (l *WordList) Check(text string) string {
+	if len(l.words) == 0 && len(l.phrases) == 0 {
+		return ""
+	}
+	words := tokens(text)
+	var run strings.Builder
+	for i, token := range words {
+		if l.words[token] || l.words[collapse(token)] {
+			return "contains a blocked word"
+		}
+		for _, phrase := range l.phrases {
+			if hasPrefix(words[i:], phrase) {
+				return "contains a blocked word"
+			}
+		}
+		// "b a d" and "b.a.d" split into single letters, so check runs of
+		// them joined back up
+		if len([]rune(token)) == 1 {
+			run.WriteString(token)
+			continue
+		}
+		if l.runContains(run.String()) {
+			return "contains a blocked word"
+		}
+		run.Reset()
+	}
+	if l.runContains(run.String()) {
+		return "contains a blocked word"
+	}
+	return ""
+}
+
+// A run of single letters is plainly an attempt to hide something, so any
+// blocked word or phrase inside it counts
+func (l *WordList) runContains(run string) bool {
+	if len([]rune(run)) < 2 {
+		return false
+	}
+	collapsed := collapse(run)
+	contains := func(word string) bool {
+		return strings.Contains(run, word) || strings.Contains(collapsed, word)
+	}
+	for word := range l.words {
+		if contains(word) {
+			return true
+		}
+	}
+	for _, phrase := range l.phrases {
+		if contains(strings.Join(phrase, "")) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPrefix() reports whether words start with the phrase, each word
+// matching as it is or with repeated letters collapsed
+func hasPrefix(words, phrase []string) bool {
+	if len(words) < len(phrase) {
+		return false
+	}
+	for i, word := range phrase {
+		if words[i] != word && collapse(words[i]) != word {
+			return false
+		}
+	}
+	return true
+}
+
+// The tokens() function lowercases text, undoes leetspeak and splits it into
+// words on anything that isn't a letter. Repeated letters are kept, so "too"
+// and "to" stay different words
+func tokens(text string) []string {
+	var words []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+	runes := []rune(text)
+	for i, r := range runes {
+		r = unicode.ToLower(r)
+		if mapped, ok := leet[r]; ok && standsForLetter(runes, i, word.Len() > 0) {
+			r = mapped
+		}
+		if unicode.IsLetter(r) {
+			word.WriteRune(r)
+			continue
+		}
+		flush()
+	}
+	flush()
+	return words
+}
+
+// Digits only stand for letters inside or next to a word, otherwise "5 stars"
+// would read as "s stars". Symbols must be followed by a letter too, so a
+// trailing "!" stays punctuation
+func standsForLetter(runes []rune, i int, inWord bool) bool {
+	next := i+1 < len(runes) && (unicode.IsLetter(runes[i+1]) || leet[runes[i+1]] != 0)
+	if unicode.IsDigit(runes[i]) {
+		return inWord || next
+	}
+	return next
+}
+
+// The collapse() function squeezes repeated letters, "baaad" becomes "bad".
+// Text is matched both as written and collapsed, blocked words only as written
+func collapse(s string) string {
+	var b strings.Builder
+	var last rune
+	for i, r := range s {
+		if i > 0 && r == last {
+			continue
+		}
+		b.WriteRune(r)
+		last = r
+	}
+	return b.String()
+}
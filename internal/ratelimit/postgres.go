@@ -0,0 +1,87 @@
+// Filename: internal/ratelimit/postgres.go
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PostgresStore keeps limits in the rate_limits table so every instance
+// using the same database shares them
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+func (s PostgresStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	interval := limit.interval()
+	allowAt := now.Add(time.Duration(limit.Burst-1) * interval)
+
+	// The common case is a known key with requests to spare. The row lock
+	// taken by the UPDATE makes concurrent requests for one key take turns
+	query := `
+		UPDATE rate_limits
+		SET tat = GREATEST(tat, $2) + $3 * interval '1 microsecond'
+		WHERE key = $1 AND tat <= $4
+		RETURNING tat
+	`
+	var tat time.Time
+	err := s.DB.QueryRowContext(ctx, query, key, now, interval.Microseconds(), allowAt).Scan(&tat)
+	if err == nil {
+		return allowed(now, tat, limit), nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Result{}, err
+	}
+	// Either the key is new or it is over its limit
+	query = `
+		INSERT INTO rate_limits (key, tat)
+		VALUES ($1, $2)
+		ON CONFLICT (key) DO NOTHING
+		RETURNING tat
+	`
+	err = s.DB.QueryRowContext(ctx, query, key, now.Add(interval)).Scan(&tat)
+	if err == nil {
+		return allowed(now, tat, limit), nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Result{}, err
+	}
+	err = s.DB.QueryRowContext(ctx, `SELECT tat FROM rate_limits WHERE key = $1`, key).Scan(&tat)
+	if err != nil {
+		return Result{}, err
+	}
+	result, _ := decide(now, tat, limit)
+	// Another request may have freed the key in between, that one is
+	// still refused rather than going round again
+	result.Allowed = false
+	if result.RetryAfter <= 0 {
+		result.RetryAfter = interval
+	}
+	return result, nil
+}
+
+// DeleteExpired() removes up to batchSize keys whose burst has fully refilled
+func (s PostgresStore) DeleteExpired(batchSize int) (int64, error) {
+	query := `
+		DELETE FROM rate_limits
+		WHERE key IN (
+			SELECT key FROM rate_limits
+			WHERE tat < NOW()
+			LIMIT $1
+		)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.DB.ExecContext(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
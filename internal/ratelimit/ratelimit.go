@@ -0,0 +1,77 @@
+// Filename: internal/ratelimit/ratelimit.go
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// A Limit allows Rate requests per second on average with bursts of up to
+// Burst requests
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// interval() is the time it takes to earn back one request
+func (l Limit) interval() time.Duration {
+	return time.Duration(float64(time.Second) / l.Rate)
+}
+
+// The Result of asking for one request
+type Result struct {
+	Allowed    bool
+	Limit      int           // the burst size
+	Remaining  int           // requests that could be made straight away
+	Reset      time.Duration // until the full burst is available again
+	RetryAfter time.Duration // until the next request is allowed, zero if allowed
+}
+
+// A Store keeps the state of every limited key. Keys sharing a store share
+// their limits, so a shared store limits clients across instances
+type Store interface {
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// Both stores use the generic cell rate algorithm. Each key only needs the
+// theoretical arrival time (tat) of its next request: a request is allowed
+// when tat is no further ahead of now than the burst allows, and each
+// allowed request pushes tat on by one interval. A tat in the past is the
+// same as a full burst, so those keys can be forgotten
+
+// decide() applies the algorithm to a key whose tat is already known
+func decide(now, tat time.Time, limit Limit) (Result, time.Time) {
+	interval := limit.interval()
+	if tat.Before(now) {
+		tat = now
+	}
+	// The latest tat that still allows a request
+	allowAt := now.Add(time.Duration(limit.Burst-1) * interval)
+	if tat.After(allowAt) {
+		return Result{
+			Allowed:    false,
+			Limit:      limit.Burst,
+			Remaining:  0,
+			Reset:      tat.Sub(now),
+			RetryAfter: tat.Sub(allowAt),
+		}, tat
+	}
+	tat = tat.Add(interval)
+	return allowed(now, tat, limit), tat
+}
+
+// allowed() describes an allowed request that moved tat to its new value
+func allowed(now, tat time.Time, limit Limit) Result {
+	interval := limit.interval()
+	ahead := tat.Sub(now)
+	remaining := limit.Burst - int((ahead+interval-1)/interval)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Result{
+		Allowed:   true,
+		Limit:     limit.Burst,
+		Remaining: remaining,
+		Reset:     ahead,
+	}
+}
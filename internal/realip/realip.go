@@ -0,0 +1,134 @@
+// Filename: internal/realip/realip.go
+package realip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// A Resolver finds the address of the client behind any trusted proxies.
+// Forwarding headers are only believed when they were added by a proxy we
+// trust, anyone else could have written whatever they liked. Only the one
+// header our proxies set is read, a client could send any of the others
+type Resolver struct {
+	trusted []*net.IPNet
+	header  string
+}
+
+// The New() function creates a resolver trusting the given networks and
+// reading the given header, one of Forwarded, X-Forwarded-For or X-Real-IP.
+// Bare addresses are trusted on their own
+func New(proxies []string, header string) (*Resolver, error) {
+	res := &Resolver{header: http.CanonicalHeaderKey(header)}
+	switch res.header {
+	case "Forwarded", "X-Forwarded-For", "X-Real-Ip":
+	default:
+		return nil, fmt.Errorf("unsupported forwarding header %q", header)
+	}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: proxy}
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			res.trusted = append(res.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		res.trusted = append(res.trusted, network)
+	}
+	return res, nil
+}
+
+// Trusted() reports whether an address belongs to a trusted proxy
+func (res *Resolver) Trusted(ip net.IP) bool {
+	for _, network := range res.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP() returns the address of the client that sent a request
+func (res *Resolver) ClientIP(r *http.Request) string {
+	peer := parseIP(r.RemoteAddr)
+	if peer == nil {
+		return r.RemoteAddr
+	}
+	if !res.Trusted(peer) {
+		return peer.String()
+	}
+	var hops []string
+	switch res.header {
+	case "Forwarded":
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	case "X-Forwarded-For":
+		hops = splitList(r.Header.Values("X-Forwarded-For"))
+	case "X-Real-Ip":
+		hops = splitList(r.Header.Values("X-Real-IP"))
+	}
+	// Each proxy appends the address it got the request from, so walk back
+	// from our peer until the first hop we don't trust. The hops before it
+	// were written by the client and can't be relied on
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseIP(hops[i])
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !res.Trusted(ip) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// splitList() joins repeated headers and splits their comma separated values
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			list = append(list, strings.TrimSpace(item))
+		}
+	}
+	return list
+}
+
+// forwardedFor() picks the for= parameter out of each element of RFC 7239
+// Forwarded headers. Elements without one count as unusable hops
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, element := range splitList(values) {
+		hop := ""
+		for _, pair := range strings.Split(element, ";") {
+			name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if found && strings.EqualFold(name, "for") {
+				hop = strings.Trim(value, `"`)
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// parseIP() reads an address with or without a port, IPv6 addresses with a
+// port are written in brackets. Anything else, such as the "unknown" or
+// obfuscated identifiers Forwarded allows, gives nil
+func parseIP(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	return net.ParseIP(s)
+}
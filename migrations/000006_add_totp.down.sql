@@ -0,0 +1,3 @@
+--Filename: migrations/000006_add_totp.down.sql
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS users_totp;
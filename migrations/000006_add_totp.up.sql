@@ -0,0 +1,14 @@
+--Filename: migrations/000006_add_totp.up.sql
+CREATE TABLE IF NOT EXISTS users_totp (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    secret_encrypted bytea NOT NULL,
+    confirmed bool NOT NULL DEFAULT false,
+    last_used_step bigint NOT NULL DEFAULT 0,
+    createdat timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+--one-time recovery codes, a row is deleted once it has been used
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    hash bytea PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE
+);
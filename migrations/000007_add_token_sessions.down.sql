@@ -0,0 +1,7 @@
+--Filename: migrations/000007_add_token_sessions.down.sql
+DROP INDEX IF EXISTS tokens_user_id_scope_idx;
+ALTER TABLE tokens DROP COLUMN IF EXISTS ip;
+ALTER TABLE tokens DROP COLUMN IF EXISTS user_agent;
+ALTER TABLE tokens DROP COLUMN IF EXISTS last_used_at;
+ALTER TABLE tokens DROP COLUMN IF EXISTS createdat;
+ALTER TABLE tokens DROP COLUMN IF EXISTS id;
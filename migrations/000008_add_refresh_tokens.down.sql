@@ -0,0 +1,4 @@
+--Filename: migrations/000008_add_refresh_tokens.down.sql
+DROP INDEX IF EXISTS tokens_family_idx;
+ALTER TABLE tokens DROP COLUMN IF EXISTS used;
+ALTER TABLE tokens DROP COLUMN IF EXISTS family;
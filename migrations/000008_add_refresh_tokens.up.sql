@@ -0,0 +1,6 @@
+--Filename: migrations/000008_add_refresh_tokens.up.sql
+--tokens issued together on login, and every rotation after it, share a family
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used bool NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family) WHERE family <> '';
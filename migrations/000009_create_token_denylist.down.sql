@@ -0,0 +1,2 @@
+--Filename: migrations/000009_create_token_denylist.down.sql
+DROP TABLE IF EXISTS token_denylist;
@@ -0,0 +1,6 @@
+--Filename: migrations/000009_create_token_denylist.up.sql
+--ids of signed access tokens that were revoked before they expired
+CREATE TABLE IF NOT EXISTS token_denylist (
+    jti text PRIMARY KEY,
+    expiry timestamp(0) with time zone NOT NULL
+);
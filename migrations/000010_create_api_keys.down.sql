@@ -0,0 +1,4 @@
+--Filename: migrations/000010_create_api_keys.down.sql
+DROP TABLE IF EXISTS api_keys;
+ALTER TABLE users DROP COLUMN IF EXISTS owner_id;
+ALTER TABLE users DROP COLUMN IF EXISTS service_account;
@@ -0,0 +1,18 @@
+--Filename: migrations/000010_create_api_keys.up.sql
+--service accounts are users that cannot log in and belong to a real user
+ALTER TABLE users ADD COLUMN IF NOT EXISTS service_account bool NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS owner_id bigint REFERENCES users ON DELETE CASCADE;
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id bigserial PRIMARY KEY,
+    createdat timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    hash bytea UNIQUE NOT NULL,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    name text NOT NULL,
+    permissions text[] NOT NULL,
+    expiry timestamp(0) with time zone,
+    ip_allowlist text[] NOT NULL DEFAULT '{}',
+    last_used_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id);
@@ -0,0 +1,5 @@
+--Filename: migrations/000011_create_oauth.down.sql
+ALTER TABLE tokens DROP COLUMN IF EXISTS oauth_client_id;
+ALTER TABLE tokens DROP COLUMN IF EXISTS permissions;
+DROP TABLE IF EXISTS oauth_authorization_codes;
+DROP TABLE IF EXISTS oauth_clients;
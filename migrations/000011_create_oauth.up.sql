@@ -0,0 +1,24 @@
+--Filename: migrations/000011_create_oauth.up.sql
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id bigserial PRIMARY KEY,
+    createdat timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    client_id text UNIQUE NOT NULL,
+    secret_hash bytea, --null for public clients such as SPAs and mobile apps
+    name text NOT NULL,
+    redirect_uris text[] NOT NULL,
+    owner_id bigint NOT NULL REFERENCES users ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS oauth_authorization_codes (
+    hash bytea PRIMARY KEY,
+    client_id bigint NOT NULL REFERENCES oauth_clients ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    redirect_uri text NOT NULL,
+    scopes text[] NOT NULL,
+    code_challenge text NOT NULL,
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+--tokens issued to a client are limited to the scopes the user consented to
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS permissions text[];
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS oauth_client_id bigint REFERENCES oauth_clients ON DELETE CASCADE;
@@ -0,0 +1,4 @@
+--Filename: migrations/000012_add_roles.down.sql
+DROP TABLE IF EXISTS users_roles;
+DROP TABLE IF EXISTS roles_permissions;
+DROP TABLE IF EXISTS roles;
@@ -0,0 +1,35 @@
+--Filename: migrations/000012_add_roles.up.sql
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name text UNIQUE NOT NULL
+);
+
+--roles group permission codes so they can be granted together
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions (id) ON DELETE CASCADE,
+    PRIMARY KEY(role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    PRIMARY KEY(user_id, role_id)
+);
+
+INSERT INTO roles (name)
+VALUES ('member'), ('moderator'), ('admin')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE (roles.name = 'member' AND permissions.code = 'forum:read')
+OR (roles.name IN ('moderator', 'admin') AND permissions.code IN ('forum:read', 'forum:write'))
+ON CONFLICT DO NOTHING;
+
+--users from before roles get the default one, service accounts only have
+--the permissions their keys were created with
+INSERT INTO users_roles
+SELECT users.id, roles.id FROM users, roles
+WHERE roles.name = 'member' AND NOT users.service_account
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,3 @@
+--Filename: migrations/000013_add_admin.down.sql
+DROP TABLE IF EXISTS audit_events;
+DELETE FROM permissions WHERE code IN ('admin:read', 'admin:write');
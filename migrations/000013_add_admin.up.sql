@@ -0,0 +1,22 @@
+--Filename: migrations/000013_add_admin.up.sql
+INSERT INTO permissions (code)
+SELECT code FROM (VALUES ('admin:read'), ('admin:write')) AS new (code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = new.code);
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code IN ('admin:read', 'admin:write')
+ON CONFLICT DO NOTHING;
+
+--who changed what, rows are never updated or deleted
+CREATE TABLE IF NOT EXISTS audit_events (
+    id bigserial PRIMARY KEY,
+    createdat timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    actor_id bigint REFERENCES users ON DELETE SET NULL,
+    action text NOT NULL,
+    target_type text NOT NULL,
+    target_id bigint,
+    details jsonb NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_target_idx ON audit_events (target_type, target_id);
@@ -0,0 +1,2 @@
+--Filename: migrations/000014_add_forum_permissions.down.sql
+DROP TABLE IF EXISTS users_forum_permissions;
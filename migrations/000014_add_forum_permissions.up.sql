@@ -0,0 +1,8 @@
+--Filename: migrations/000014_add_forum_permissions.up.sql
+--grants that only apply to a single forum, such as a per-forum moderator
+CREATE TABLE IF NOT EXISTS users_forum_permissions (
+    user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions (id) ON DELETE CASCADE,
+    forum_id bigint NOT NULL REFERENCES forums (id) ON DELETE CASCADE,
+    PRIMARY KEY(user_id, forum_id, permission_id)
+);
@@ -0,0 +1,9 @@
+--Filename: migrations/000015_extend_audit_events.down.sql
+DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+DROP FUNCTION IF EXISTS audit_events_append_only();
+DROP INDEX IF EXISTS audit_events_createdat_idx;
+DROP INDEX IF EXISTS audit_events_actor_id_idx;
+ALTER TABLE audit_events DROP COLUMN IF EXISTS request_id;
+ALTER TABLE audit_events DROP COLUMN IF EXISTS ip;
+ALTER TABLE audit_events DROP COLUMN IF EXISTS after;
+ALTER TABLE audit_events DROP COLUMN IF EXISTS before;
@@ -0,0 +1,24 @@
+--Filename: migrations/000015_extend_audit_events.up.sql
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS before jsonb;
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS after jsonb;
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS ip text NOT NULL DEFAULT '';
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS request_id text NOT NULL DEFAULT '';
+
+--the actor id is kept as history even once the user is gone, a foreign key
+--would have to rewrite old rows
+ALTER TABLE audit_events DROP CONSTRAINT IF EXISTS audit_events_actor_id_fkey;
+
+CREATE INDEX IF NOT EXISTS audit_events_actor_id_idx ON audit_events (actor_id);
+CREATE INDEX IF NOT EXISTS audit_events_createdat_idx ON audit_events (createdat);
+
+--the log is append-only
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+CREATE TRIGGER audit_events_append_only
+BEFORE UPDATE OR DELETE ON audit_events
+FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
@@ -0,0 +1,6 @@
+--Filename: migrations/000016_add_reports.down.sql
+DROP TABLE IF EXISTS warnings;
+DROP TABLE IF EXISTS reports;
+DELETE FROM permissions WHERE code = 'forum:moderate';
+ALTER TABLE forums DROP COLUMN IF EXISTS hidden;
+ALTER TABLE forums DROP COLUMN IF EXISTS user_id;
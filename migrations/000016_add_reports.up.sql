@@ -0,0 +1,41 @@
+--Filename: migrations/000016_add_reports.up.sql
+--forums remember who created them so moderators can warn the author
+ALTER TABLE forums ADD COLUMN IF NOT EXISTS user_id bigint REFERENCES users ON DELETE SET NULL;
+ALTER TABLE forums ADD COLUMN IF NOT EXISTS hidden bool NOT NULL DEFAULT false;
+
+INSERT INTO permissions (code)
+SELECT 'forum:moderate'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'forum:moderate');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name IN ('moderator', 'admin') AND permissions.code = 'forum:moderate'
+ON CONFLICT DO NOTHING;
+
+--forum_id has no foreign key so resolved reports outlive deleted forums
+CREATE TABLE IF NOT EXISTS reports (
+    id bigserial PRIMARY KEY,
+    createdat timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    forum_id bigint NOT NULL,
+    reporter_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    reason text NOT NULL,
+    note text NOT NULL DEFAULT '',
+    status text NOT NULL DEFAULT 'open',
+    resolved_by bigint REFERENCES users ON DELETE SET NULL,
+    resolved_at timestamp(0) with time zone,
+    resolution_note text NOT NULL DEFAULT ''
+);
+
+--a user has at most one open report per forum
+CREATE UNIQUE INDEX IF NOT EXISTS reports_open_idx ON reports (forum_id, reporter_id) WHERE status = 'open';
+
+CREATE TABLE IF NOT EXISTS warnings (
+    id bigserial PRIMARY KEY,
+    createdat timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    moderator_id bigint REFERENCES users ON DELETE SET NULL,
+    forum_id bigint,
+    message text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS warnings_user_id_idx ON warnings (user_id);
@@ -0,0 +1,2 @@
+--Filename: migrations/000017_create_suspensions.down.sql
+DROP TABLE IF EXISTS suspensions;
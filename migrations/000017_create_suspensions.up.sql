@@ -0,0 +1,14 @@
+--Filename: migrations/000017_create_suspensions.up.sql
+--a suspension without an expiry is a permanent ban
+CREATE TABLE IF NOT EXISTS suspensions (
+    id bigserial PRIMARY KEY,
+    createdat timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    moderator_id bigint REFERENCES users ON DELETE SET NULL,
+    reason text NOT NULL,
+    expiry timestamp(0) with time zone,
+    lifted_at timestamp(0) with time zone,
+    lifted_by bigint REFERENCES users ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS suspensions_user_id_idx ON suspensions (user_id);
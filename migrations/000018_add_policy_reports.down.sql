@@ -0,0 +1,3 @@
+--Filename: migrations/000018_add_policy_reports.down.sql
+DELETE FROM reports WHERE reporter_id IS NULL;
+ALTER TABLE reports ALTER COLUMN reporter_id SET NOT NULL;
@@ -0,0 +1,3 @@
+--Filename: migrations/000018_add_policy_reports.up.sql
+--reports raised by the content policy rather than a user have no reporter
+ALTER TABLE reports ALTER COLUMN reporter_id DROP NOT NULL;
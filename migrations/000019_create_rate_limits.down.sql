@@ -0,0 +1,2 @@
+--Filename: migrations/000019_create_rate_limits.down.sql
+DROP TABLE IF EXISTS rate_limits;
@@ -0,0 +1,8 @@
+--Filename: migrations/000019_create_rate_limits.up.sql
+--one row per limited key, tat is when its next request is theoretically due
+CREATE TABLE IF NOT EXISTS rate_limits (
+    key text PRIMARY KEY,
+    tat timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS rate_limits_tat_idx ON rate_limits (tat);
@@ -0,0 +1,17 @@
+--Filename: migrations/000020_create_idempotency_keys.up.sql
+--status stays null while the first request with a key is being served, if
+--that request dies the key can be claimed again once locked_until passes
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    key text NOT NULL,
+    createdat timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expiry timestamp(0) with time zone NOT NULL,
+    locked_until timestamp(0) with time zone NOT NULL,
+    fingerprint bytea NOT NULL,
+    status integer,
+    header jsonb NOT NULL DEFAULT '{}',
+    body bytea NOT NULL DEFAULT '',
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expiry_idx ON idempotency_keys (expiry);
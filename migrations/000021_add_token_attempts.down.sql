@@ -0,0 +1,2 @@
+--Filename: migrations/000021_add_token_attempts.down.sql
+ALTER TABLE tokens DROP COLUMN IF EXISTS attempts;
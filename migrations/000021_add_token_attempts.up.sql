@@ -0,0 +1,3 @@
+--Filename: migrations/000021_add_token_attempts.up.sql
+--failed guesses against a token, challenges are deleted after too many
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS attempts integer NOT NULL DEFAULT 0;